@@ -0,0 +1,185 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/app"
+	"go.uber.org/dig"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+func GetCacheCommand(c *dig.Container) *cobra.Command {
+	var root = &cobra.Command{
+		Use:   "cache",
+		Short: "maintain the S3 cache",
+	}
+	root.AddCommand(GetCacheScrubCommand(c), GetCacheReconcileCommand(c), GetCacheWarmCommand(c))
+	return root
+}
+
+func GetCacheScrubCommand(c *dig.Container) *cobra.Command {
+	var dryRun bool
+	var root = &cobra.Command{
+		Use:   "scrub",
+		Short: "verify every cached object against its cid and quarantine mismatches",
+		Run: func(cmd *cobra.Command, args []string) {
+			err := c.Invoke(func(m *app.CacheManager) {
+				if m == nil {
+					fmt.Println("No S3 cache configured")
+					return
+				}
+				r := m.Scrub(dryRun)
+				fmt.Println("\nResult:")
+				fmt.Println("Checked:     ", r.Checked)
+				fmt.Println("Passed:      ", r.Passed)
+				fmt.Println("Mismatched:  ", r.Mismatched)
+				fmt.Println("Quarantined: ", r.Quarantined)
+				fmt.Println("Errors:      ", r.Errors)
+				fmt.Println("Bytes:       ", r.Bytes)
+				fmt.Println("Duration:    ", r.Duration)
+			})
+			if err != nil {
+				fmt.Println(err)
+			}
+		},
+	}
+	root.Flags().BoolVar(&dryRun, "dry-run", false, "only report, do not quarantine or record results")
+	return root
+}
+
+func GetCacheReconcileCommand(c *dig.Container) *cobra.Command {
+	var dryRun bool
+	var root = &cobra.Command{
+		Use:   "reconcile",
+		Short: "compare the bucket with the db, fix sizes, remove orphans and re-fetch missing objects",
+		Run: func(cmd *cobra.Command, args []string) {
+			err := c.Invoke(func(m *app.CacheManager) {
+				if m == nil {
+					fmt.Println("No S3 cache configured")
+					return
+				}
+				r := m.Reconcile(dryRun)
+				fmt.Println("\nResult:")
+				if r.DryRun {
+					fmt.Println("(dry run, nothing was changed)")
+				}
+				fmt.Println("Objects in bucket: ", r.Objects)
+				fmt.Println("Records in db:     ", r.Records)
+				fmt.Println("Records fixed:     ", r.SizesFixed)
+				fmt.Println("Orphans removed:   ", r.OrphansRemoved)
+				fmt.Println("Missing objects:   ", r.Missing)
+				fmt.Println("Re-fetched:        ", r.Refetched)
+				fmt.Println("Re-fetch failed:   ", r.RefetchFailed)
+				fmt.Println("Errors:            ", r.Errors)
+				fmt.Println("Duration:          ", r.Duration)
+			})
+			if err != nil {
+				fmt.Println(err)
+			}
+		},
+	}
+	root.Flags().BoolVar(&dryRun, "dry-run", false, "only report, do not change the bucket or db")
+	return root
+}
+
+func GetCacheWarmCommand(c *dig.Container) *cobra.Command {
+	var from, token string
+	var workers int
+	var root = &cobra.Command{
+		Use:   "warm [file]",
+		Short: "fill the cache from a cid list file, stdin (no file or -) or another gateway (--from)",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			var cids []string
+			var err error
+			if from != "" {
+				cids, err = readRemoteIndex(from, token)
+			} else if len(args) == 0 || args[0] == "-" {
+				cids, err = readCidList(os.Stdin)
+			} else {
+				f, e := os.Open(args[0])
+				if e != nil {
+					fmt.Println(e)
+					return
+				}
+				defer f.Close()
+				cids, err = readCidList(f)
+			}
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			fmt.Println("Warming cache with", len(cids), "cids")
+
+			origin := "warm"
+			if from != "" {
+				origin = from
+			}
+			err = c.Invoke(func(m *app.CacheManager) {
+				if m == nil {
+					fmt.Println("No S3 cache configured")
+					return
+				}
+				r := m.Warm(cids, workers, origin, func(p app.WarmProgress) {
+					fmt.Printf("\r[%d/%d] fetched: %d skipped: %d failed: %d", p.Done, p.Total, p.Fetched, p.Skipped, p.Failed)
+				})
+				fmt.Println("\n\nResult:")
+				fmt.Println("Fetched: ", r.Fetched)
+				fmt.Println("Skipped: ", r.Skipped)
+				fmt.Println("Failed:  ", r.Failed)
+				fmt.Println("Bytes:   ", r.Bytes)
+				fmt.Println("Duration:", r.Duration)
+			})
+			if err != nil {
+				fmt.Println(err)
+			}
+		},
+	}
+	root.Flags().StringVar(&from, "from", "", "gateway url to copy the cache index from, e.g. http://gateway:8085")
+	root.Flags().StringVar(&token, "token", "", "access token for --from")
+	root.Flags().IntVar(&workers, "workers", 4, "number of parallel fetches")
+	return root
+}
+
+// readCidList reads one cid per line, empty lines and # comments are ignored
+func readCidList(r io.Reader) ([]string, error) {
+	res := []string{}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		res = append(res, line)
+	}
+	return res, s.Err()
+}
+
+func readRemoteIndex(url string, token string) ([]string, error) {
+	req, err := http.NewRequest("GET", strings.TrimRight(url, "/")+"/cache/index", nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Token", token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 404 {
+		return nil, fmt.Errorf("remote index returned %s, is Gateway.Server.CacheIndex enabled there?", resp.Status)
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("remote index returned %s", resp.Status)
+	}
+	res := []string{}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	return res, err
+}
@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/app"
+	"go.uber.org/dig"
+)
+
+func GetPinCommand(c *dig.Container) *cobra.Command {
+	var root = &cobra.Command{
+		Use:   "pin",
+		Short: "maintain pins of the storage node",
+	}
+	root.AddCommand(GetPinReconcileCommand(c))
+	return root
+}
+
+func GetPinReconcileCommand(c *dig.Container) *cobra.Command {
+	var dryRun bool
+	var root = &cobra.Command{
+		Use:   "reconcile",
+		Short: "compare the db with the pins of the IPFS node, import, re-pin and remove what differs",
+		Run: func(cmd *cobra.Command, args []string) {
+			err := c.Invoke(func(pin *app.PinReconciler) {
+				r := pin.Reconcile(dryRun)
+				fmt.Println("\nResult:")
+				if r.DryRun {
+					fmt.Println("(dry run, nothing was changed)")
+				}
+				fmt.Println("Pins on node:  ", r.NodePins)
+				fmt.Println("Records in db: ", r.Records)
+				fmt.Println("Imported:      ", r.Imported)
+				fmt.Println("Missing:       ", r.Missing)
+				fmt.Println("Re-queued:     ", r.Requeued)
+				fmt.Println("Removed:       ", r.Removed)
+				fmt.Println("Errors:        ", r.Errors)
+				fmt.Println("Duration:      ", r.Duration)
+			})
+			if err != nil {
+				fmt.Println(err)
+			}
+		},
+	}
+	root.Flags().BoolVar(&dryRun, "dry-run", false, "only report, do not change the db or the node")
+	return root
+}
@@ -16,6 +16,8 @@ func GetRootCommand(c *dig.Container) *cobra.Command {
 
 	root.AddCommand(GetConfigCommand(c), GetRunCommand(c))
 	root.AddCommand(GetToolsCommand(c))
+	root.AddCommand(GetCacheCommand(c))
+	root.AddCommand(GetPinCommand(c))
 	return root
 }
 
@@ -24,13 +26,19 @@ func GetRunCommand(c *dig.Container) *cobra.Command {
 		Use:   "run",
 		Short: "run daemon",
 		Run: func(cmd *cobra.Command, args []string) {
-			err := c.Invoke(func(a *app.Admin, g *app.Gateway) {
+			err := c.Invoke(func(a *app.Admin, g *app.Gateway, m *app.CacheManager, p *app.PinningService) {
 				if a != nil {
 					go a.Run()
 				}
 				if g != nil {
 					go g.Run()
 				}
+				if m != nil {
+					go m.Run()
+				}
+				if p != nil {
+					go p.Run()
+				}
 			})
 
 			if err != nil {
@@ -4,6 +4,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/cache"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/common"
 	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/config"
 	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/db"
 	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/network"
@@ -20,9 +21,10 @@ type Admin struct {
 	pin *PinManager
 	gateway *Gateway
 	cache *cache.S3Cache
+	replicator *Replicator
 }
 
-func NewAdminAPI(s *swarm.Swarm, db *db.StormDB, net network.NetworkInterface, l *logrus.Entry, c *config.Config,pin *PinManager, gateway *Gateway, cache *cache.S3Cache) *Admin {
+func NewAdminAPI(s *swarm.Swarm, db *db.StormDB, net network.NetworkInterface, l *logrus.Entry, c *config.Config,pin *PinManager, gateway *Gateway, cache *cache.S3Cache, replicator *Replicator) *Admin {
 	a := Admin{
 		swarm: s,
 		db: db,
@@ -32,6 +34,7 @@ func NewAdminAPI(s *swarm.Swarm, db *db.StormDB, net network.NetworkInterface, l
 		pin: pin,
 		gateway: gateway,
 		cache: cache,
+		replicator: replicator,
 	}
 	return &a
 }
@@ -44,41 +47,257 @@ func (a *Admin) Run() {
 	r.POST("/pin/:cid",a.pinRequest)
 	r.DELETE("/pin/:cid",a.unPinReuest)
 	r.POST("/pin/:cid/block",a.blockRequest)
+	r.POST("/pin/:cid/renew",a.renewRequest)
+	r.POST("/gc",a.gcRequest)
+	r.GET("/gc",a.lastGCRequest)
+	r.GET("/pins/queue",a.pinQueueRequest)
+	r.GET("/quotas",a.quotaRequest)
+	r.GET("/pins",a.listPinsRequest)
+	r.GET("/pin/:cid",a.getPinRequest)
+	r.GET("/cache",a.listCacheRequest)
+	r.GET("/replication",a.replicationRequest)
+	r.GET("/peers",a.peersRequest)
+	r.GET("/peers/stats",a.peerStatsRequest)
+	r.GET("/peers/stats/:peer",a.peerChallengesRequest)
+	r.GET("/federations",a.federationsRequest)
+	r.GET("/events",a.eventsRequest)
 	r.GET("/id",a.idRequest)
 	r.Run(a.c.Admin.Host + ":" + strconv.Itoa(a.c.Admin.Port))
 }
 
 func (a *Admin) pinRequest(c *gin.Context){
 	cid := c.Param("cid")
+	if _, err := common.CidKey(cid); err != nil {
+		c.String(400, "invalid cid: "+err.Error())
+		return
+	}
+	replicas, err := strconv.Atoi(c.DefaultQuery("replicas", "0"))
+	if err != nil || replicas < 0 {
+		c.String(400, "invalid replicas")
+		return
+	}
+	expires, err := parseLease(c.Query("expires"), c.Query("lease"))
+	if err != nil {
+		c.String(400, err.Error())
+		return
+	}
 	if a.pin != nil {
-		a.pin.Pin(cid)
+		a.pin.Pin(cid, expires)
 	}
+	a.replicator.Track(cid, replicas, expires)
 	c.String(200, "ok")
 }
 
 func (a *Admin) unPinReuest(c *gin.Context){
 	cid := c.Param("cid")
+	key, err := common.CidKey(cid)
+	if err != nil {
+		c.String(400, "invalid cid: "+err.Error())
+		return
+	}
 	if a.pin != nil {
 		a.pin.UnPin(cid)
 	}
-	if a.cache != nil {
-		a.cache.Uncache(cid)
-	}
+	a.replicator.Untrack(key)
+	a.uncache(key)
 	c.String(200, "ok")
 }
 
 func (a *Admin) blockRequest(c *gin.Context){
 	cid := c.Param("cid")
+	key, err := common.CidKey(cid)
+	if err != nil {
+		c.String(400, "invalid cid: "+err.Error())
+		return
+	}
 	if a.pin != nil {
 		a.pin.Block(cid)
 	}
-	if a.cache != nil {
-		a.cache.Uncache(cid)
+	a.replicator.Untrack(key)
+	a.uncache(key)
+	c.String(200, "ok")
+}
+
+
+// renewRequest sets a new lease locally and announces it to our storage peers
+func (a *Admin) renewRequest(c *gin.Context){
+	cid := c.Param("cid")
+	key, err := common.CidKey(cid)
+	if err != nil {
+		c.String(400, "invalid cid: "+err.Error())
+		return
+	}
+	expires, err := parseLease(c.Query("expires"), c.Query("lease"))
+	if err != nil {
+		c.String(400, err.Error())
+		return
+	}
+	if a.pin != nil {
+		a.pin.Renew(cid, expires)
+	}
+	a.replicator.Renew(key, expires)
+	req := swarm.PinRequest{
+		Cid:     cid,
+		Expires: expires,
 	}
+	sendTo(a.net, a.swarm.ForUsIn(), req.ToTransportFormat())
 	c.String(200, "ok")
 }
 
+func (a *Admin) gcRequest(c *gin.Context){
+	if a.pin == nil {
+		c.String(404, "PinManager disabled")
+		return
+	}
+	c.JSON(200, a.pin.GC(c.Query("dry-run") == "true"))
+}
+
+func (a *Admin) lastGCRequest(c *gin.Context){
+	if a.pin == nil {
+		c.String(404, "PinManager disabled")
+		return
+	}
+	report := a.pin.LastGC()
+	if report == nil {
+		c.String(404, "no garbage collection yet")
+		return
+	}
+	c.JSON(200, report)
+}
+
+func (a *Admin) pinQueueRequest(c *gin.Context){
+	if a.pin == nil {
+		c.String(404, "PinManager disabled")
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil {
+		c.String(400, "invalid limit")
+		return
+	}
+	c.JSON(200, a.pin.QueueStatus(limit))
+}
+
+// replicationRequest lists under-replicated cids, or all tracked ones with ?all=true
+func (a *Admin) replicationRequest(c *gin.Context){
+	var res []ReplicaStatus
+	var err error
+	if c.Query("all") == "true" {
+		res, err = a.replicator.Status()
+	} else {
+		res, err = a.replicator.UnderReplicated()
+	}
+	if err != nil {
+		c.String(500, err.Error())
+		return
+	}
+	c.JSON(200, res)
+}
+
+func (a *Admin) peerStatsRequest(c *gin.Context){
+	res, err := a.replicator.PeerReports()
+	if err != nil {
+		c.String(500, err.Error())
+		return
+	}
+	c.JSON(200, res)
+}
+
+// peerChallengesRequest shows the latest challenges of a peer
+func (a *Admin) peerChallengesRequest(c *gin.Context){
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit < 1 {
+		c.String(400, "invalid limit")
+		return
+	}
+	res, err := a.db.GetChallenges(c.Param("peer"), limit)
+	if err != nil {
+		c.String(500, err.Error())
+		return
+	}
+	c.JSON(200, res)
+}
+
+type PeerStatus struct {
+	network.PeerInfo
+	Name     string // from its advertisement
+	Trusted  bool
+	PinFor   bool
+	CacheFor bool
+}
+
+// peersRequest shows connection state and discovery source of our peers
+func (a *Admin) peersRequest(c *gin.Context){
+	res := []PeerStatus{}
+	for _, info := range a.net.Peers() {
+		status := PeerStatus{
+			PeerInfo: info,
+			Trusted:  a.swarm.IsTrusted(info.ID),
+			PinFor:   a.swarm.PinFor(info.ID),
+			CacheFor: a.swarm.CacheFor(info.ID),
+		}
+		if adv := a.swarm.Advertisement(info.ID); adv != nil {
+			status.Name = adv.Name
+		}
+		res = append(res, status)
+	}
+	c.JSON(200, res)
+}
+
+type FederationStatus struct {
+	network.FederationStats
+	Peers     swarm.FederationStats
+	Connected int // members we are connected to
+}
+
+// federationsRequest shows traffic and peers of every federation we take part in
+func (a *Admin) federationsRequest(c *gin.Context){
+	connected := map[string]bool{}
+	for _, info := range a.net.Peers() {
+		connected[info.ID] = info.Connected
+	}
+	res := []FederationStatus{}
+	for _, f := range a.net.Federations() {
+		status := FederationStatus{
+			FederationStats: f,
+			Peers:           a.swarm.Stats(f.Name),
+		}
+		for _, id := range status.Peers.Members {
+			if connected[id] {
+				status.Connected++
+			}
+		}
+		res = append(res, status)
+	}
+	c.JSON(200, res)
+}
+
+func (a *Admin) quotaRequest(c *gin.Context){
+	if a.pin == nil {
+		c.String(404, "PinManager disabled")
+		return
+	}
+	c.JSON(200, a.pin.Quotas())
+}
+
+// eventsRequest shows the subscribers of the event bus and how many events they dropped
+func (a *Admin) eventsRequest(c *gin.Context){
+	c.JSON(200, a.net.Events().Stats())
+}
 
 func (a *Admin) idRequest(c *gin.Context){
 	c.String(200,a.net.ID())
-}
\ No newline at end of file
+}
+
+// uncache removes the object and its db record, keeps the record if the bucket failed
+func (a *Admin) uncache(key string) {
+	if a.cache == nil {
+		return
+	}
+	if err := a.cache.Uncache(key); err != nil {
+		return
+	}
+	if entry, err := a.db.GetCache(key); err == nil {
+		a.db.RemoveCache(entry)
+	}
+}
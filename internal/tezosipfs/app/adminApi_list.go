@@ -0,0 +1,129 @@
+package app
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/common"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/db"
+	"strconv"
+	"time"
+)
+
+type PinList struct {
+	Total      int
+	TotalBytes int64
+	Page       int
+	PageSize   int
+	Pins       []common.Pin
+}
+
+type CacheList struct {
+	Total      int
+	TotalBytes int64
+	Page       int
+	PageSize   int
+	Entries    []common.Cache
+}
+
+type PinDetails struct {
+	Pin      *common.Pin
+	Attempts []common.PinAttempt
+	Acks     []common.PinAck
+	Remote   []common.RemotePin
+}
+
+func (a *Admin) listPinsRequest(c *gin.Context) {
+	f, err := parseFilter(c)
+	if err != nil {
+		c.String(400, err.Error())
+		return
+	}
+	pins, totals, err := a.db.FindPins(f)
+	if err != nil {
+		c.String(500, err.Error())
+		return
+	}
+	c.JSON(200, PinList{
+		Total:      totals.Count,
+		TotalBytes: totals.Bytes,
+		Page:       f.Page,
+		PageSize:   f.PageSize,
+		Pins:       pins,
+	})
+}
+
+func (a *Admin) listCacheRequest(c *gin.Context) {
+	f, err := parseFilter(c)
+	if err != nil {
+		c.String(400, err.Error())
+		return
+	}
+	entries, totals, err := a.db.FindCache(f)
+	if err != nil {
+		c.String(500, err.Error())
+		return
+	}
+	c.JSON(200, CacheList{
+		Total:      totals.Count,
+		TotalBytes: totals.Bytes,
+		Page:       f.Page,
+		PageSize:   f.PageSize,
+		Entries:    entries,
+	})
+}
+
+func (a *Admin) getPinRequest(c *gin.Context) {
+	key, err := common.CidKey(c.Param("cid"))
+	if err != nil {
+		c.String(400, "invalid cid: "+err.Error())
+		return
+	}
+	p, err := a.db.GetPin(key)
+	if err != nil {
+		c.String(404, "not found")
+		return
+	}
+	res := PinDetails{Pin: p}
+	res.Attempts, _ = a.db.GetPinAttempts(key)
+	res.Acks, _ = a.db.GetPinAcks(key)
+	res.Remote, _ = a.db.GetRemotePins(key)
+	c.JSON(200, res)
+}
+
+/*
+ * parseFilter reads the query parameters shared by all list routes:
+ * status, from, since, until (RFC3339 or 2006-01-02),
+ * sort (Created, Size, Cid, Status), order (asc, desc), page and pagesize
+ */
+func parseFilter(c *gin.Context) (db.Filter, error) {
+	f := db.Filter{
+		Status:  c.Query("status"),
+		From:    c.Query("from"),
+		OrderBy: c.DefaultQuery("sort", "Created"),
+		Reverse: c.DefaultQuery("order", "desc") == "desc",
+	}
+	var err error
+	if f.Since, err = parseTime(c.Query("since")); err != nil {
+		return f, errors.New("invalid since: " + err.Error())
+	}
+	if f.Until, err = parseTime(c.Query("until")); err != nil {
+		return f, errors.New("invalid until: " + err.Error())
+	}
+	if f.Page, err = strconv.Atoi(c.DefaultQuery("page", "1")); err != nil || f.Page < 1 {
+		return f, errors.New("invalid page")
+	}
+	if f.PageSize, err = strconv.Atoi(c.DefaultQuery("pagesize", "50")); err != nil || f.PageSize < 1 || f.PageSize > 1000 {
+		return f, errors.New("invalid pagesize, must be between 1 and 1000")
+	}
+	return f, nil
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
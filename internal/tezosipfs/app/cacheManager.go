@@ -0,0 +1,174 @@
+package app
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/cache"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/common"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/config"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/db"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/network"
+	"time"
+)
+
+/*
+ * CacheManager runs maintenance jobs on the S3 cache,
+ * both scheduled from the daemon and from the cli
+ */
+type CacheManager struct {
+	cache *cache.S3Cache
+	db    *db.StormDB
+	net   network.NetworkInterface
+	log   *logrus.Entry
+	c     *config.Config
+}
+
+type ScrubReport struct {
+	Checked     int
+	Passed      int
+	Mismatched  int
+	Errors      int
+	Quarantined int
+	Bytes       int64
+	Duration    time.Duration
+}
+
+func NewCacheManager(c *config.Config, s3 *cache.S3Cache, db *db.StormDB, net network.NetworkInterface, l *logrus.Entry) *CacheManager {
+	if c.Gateway.Storage.S3.Bucket == "" {
+		l.Info("No cache configured, cache maintenance disabled")
+		return nil
+	}
+	m := CacheManager{
+		cache: s3,
+		db:    db,
+		net:   net,
+		log:   l.WithField("source", "cache-manager"),
+		c:     c,
+	}
+	return &m
+}
+
+func (m *CacheManager) Run() {
+	go m.migrateObjects()
+	if m.c.Gateway.Storage.Scrub.Enabled {
+		go m.schedule(m.c.Gateway.Storage.Scrub, func() { m.Scrub(false) })
+	}
+	if m.c.Gateway.Storage.Reconcile.Enabled {
+		go m.schedule(m.c.Gateway.Storage.Reconcile, func() { m.Reconcile(false) })
+	}
+}
+
+func (m *CacheManager) schedule(s config.Schedule, job func()) {
+	interval := time.Duration(s.Interval) * time.Hour
+	if interval <= 0 {
+		interval = 24 * time.Hour
+	}
+	for {
+		time.Sleep(interval)
+		job()
+	}
+}
+
+/*
+ * Scrub walks the whole bucket, re-imports every object to recompute
+ * its cid and moves mismatches into quarantine.
+ * In dryRun mode nothing is quarantined or recorded.
+ */
+func (m *CacheManager) Scrub(dryRun bool) *ScrubReport {
+	start := time.Now()
+	report := &ScrubReport{}
+	m.log.Info("Starting cache scrub")
+
+	keys := map[string]int64{}
+	err := m.cache.List(func(cid string, size int64, modified time.Time) {
+		keys[cid] = size
+	})
+	if err != nil {
+		m.log.Error("Failed to list cache: ", err)
+		report.Errors++
+		return report
+	}
+
+	for key, size := range keys {
+		report.Checked++
+		report.Bytes += size
+		result := &common.ScrubResult{
+			Cid:     key,
+			Checked: time.Now(),
+			Size:    size,
+		}
+		data, err := m.cache.GetRaw(key)
+		if err == nil {
+			var ok bool
+			ok, err = cache.Verify(key, data)
+			if err == nil && !ok {
+				result.Status = "mismatch"
+			}
+		}
+		if err != nil {
+			result.Status = "error"
+			result.Error = err.Error()
+			report.Errors++
+			m.log.WithField("cid", key).Warn("Could not scrub object: ", err)
+		} else if result.Status == "mismatch" {
+			report.Mismatched++
+			m.log.WithField("cid", key).Error("Cached object does not match its cid")
+			if !dryRun && m.cache.Quarantine(key) == nil {
+				report.Quarantined++
+				m.markQuarantined(key)
+			}
+		} else {
+			result.Status = "ok"
+			report.Passed++
+		}
+		if !dryRun {
+			m.db.SaveScrubResult(result)
+		}
+	}
+
+	report.Duration = time.Since(start)
+	m.log.WithField("checked", report.Checked).
+		WithField("mismatched", report.Mismatched).
+		WithField("errors", report.Errors).
+		WithField("duration", report.Duration).Info("Cache scrub completed")
+	return report
+}
+
+func (m *CacheManager) markQuarantined(key string) {
+	entry, err := m.db.GetCache(key)
+	if err != nil {
+		return
+	}
+	entry.Status = "quarantined"
+	m.db.SaveCache(entry)
+}
+
+// migrateObjects renames objects cached under their cid string to their key, see common.CidKey
+func (m *CacheManager) migrateObjects() {
+	if m.db.Migrated("cache_objects") {
+		return
+	}
+	names := []string{}
+	err := m.cache.List(func(name string, size int64, modified time.Time) {
+		names = append(names, name)
+	})
+	if err != nil {
+		m.log.Error("Failed to list cache, migrating objects on the next start: ", err)
+		return
+	}
+	failed := 0
+	for _, name := range names {
+		key, err := common.CidKey(name)
+		if err != nil || key == name {
+			continue
+		}
+		if err := m.cache.Rename(name, key); err != nil {
+			m.log.WithField("cid", name).Error("Failed to rename object to its key: ", err)
+			failed++
+			continue
+		}
+		m.log.WithField("cid", name).WithField("key", key).Info("Renamed cached object")
+	}
+	if failed == 0 {
+		m.db.SetMigrated("cache_objects")
+	}
+}
@@ -0,0 +1,149 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/common"
+	"io/ioutil"
+	"time"
+)
+
+// orphanGrace keeps new objects, they are stored before their record
+const orphanGrace = time.Hour
+
+type ReconcileReport struct {
+	Objects        int // in the bucket
+	Records        int // in the db
+	SizesFixed     int
+	OrphansRemoved int // objects without a record
+	Missing        int // records without an object
+	Refetched      int
+	RefetchFailed  int
+	Errors         int
+	DryRun         bool
+	Duration       time.Duration
+}
+
+/*
+ * Reconcile makes the common.Cache table match the bucket:
+ * sizes are taken from the bucket, objects we have no record of
+ * are removed once they are older than orphanGrace and records
+ * without an object are fetched again.
+ * In dryRun mode we only count what would be done.
+ */
+func (m *CacheManager) Reconcile(dryRun bool) *ReconcileReport {
+	start := time.Now()
+	report := &ReconcileReport{DryRun: dryRun}
+	m.log.WithField("dry_run", dryRun).Info("Starting cache reconciliation")
+
+	objects := map[string]int64{}
+	recent := map[string]bool{}
+	err := m.cache.List(func(cid string, size int64, modified time.Time) {
+		objects[cid] = size
+		recent[cid] = time.Since(modified) < orphanGrace
+	})
+	if err != nil {
+		m.log.Error("Failed to list cache: ", err)
+		report.Errors++
+		return report
+	}
+	report.Objects = len(objects)
+
+	records := map[string]*common.Cache{}
+	err = m.db.EachCache(func(c *common.Cache) error {
+		records[c.Cid] = c
+		return nil
+	})
+	if err != nil {
+		m.log.Error("Failed to read cache records: ", err)
+		report.Errors++
+		return report
+	}
+	report.Records = len(records)
+
+	for key, size := range objects {
+		record, ok := records[key]
+		if !ok && recent[key] {
+			// stored just now, the record is written right after
+			continue
+		}
+		if !ok || m.db.IsBlocked(key) {
+			report.OrphansRemoved++
+			m.log.WithField("cid", key).Trace("orphaned object")
+			if !dryRun && m.cache.Uncache(key) != nil {
+				report.Errors++
+			}
+			if ok && !dryRun {
+				m.db.RemoveCache(record)
+			}
+			continue
+		}
+		if record.Size != size || record.Status != "cached" {
+			report.SizesFixed++
+			if !dryRun {
+				record.Size = size
+				record.Status = "cached"
+				if m.db.SaveCache(record) != nil {
+					report.Errors++
+				}
+			}
+		}
+	}
+
+	for key, record := range records {
+		if _, ok := objects[key]; ok {
+			continue
+		}
+		if m.db.IsBlocked(key) {
+			continue
+		}
+		report.Missing++
+		if dryRun {
+			continue
+		}
+		if _, err := m.fetch(record.Ref(), record.From); err != nil {
+			m.log.WithField("cid", key).Warn("Could not re-fetch: ", err)
+			report.RefetchFailed++
+			continue
+		}
+		report.Refetched++
+	}
+
+	report.Duration = time.Since(start)
+	m.log.WithField("objects", report.Objects).
+		WithField("records", report.Records).
+		WithField("orphans", report.OrphansRemoved).
+		WithField("missing", report.Missing).
+		WithField("duration", report.Duration).Info("Cache reconciliation completed")
+	return report
+}
+
+// fetch gets cid from the network and stores it in the bucket and db
+func (m *CacheManager) fetch(cid string, from string) (int64, error) {
+	key, err := common.CidKey(cid)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	reader, err := m.net.GetFile(ctx, cid)
+	if err != nil {
+		return 0, err
+	}
+	buf, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return 0, err
+	}
+	err = m.cache.StoreFile(key, bytes.NewReader(buf))
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(buf)), m.db.SaveCache(&common.Cache{
+		Created:  time.Now(),
+		Cid:      key,
+		Original: common.Original(cid, key),
+		From:     from,
+		Status:   "cached",
+		Size:     int64(len(buf)),
+	})
+}
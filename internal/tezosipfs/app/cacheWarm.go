@@ -0,0 +1,85 @@
+package app
+
+import (
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/common"
+	"sync"
+	"time"
+)
+
+type WarmProgress struct {
+	Total    int
+	Done     int
+	Fetched  int
+	Skipped  int // already cached, blocked or invalid
+	Failed   int
+	Bytes    int64
+	Duration time.Duration
+}
+
+/*
+ * Warm fills the cache with cids using a bounded pool of workers,
+ * progress is called after every cid, from the worker that handled it
+ */
+func (m *CacheManager) Warm(cids []string, workers int, from string, progress func(p WarmProgress)) WarmProgress {
+	start := time.Now()
+	if workers <= 0 {
+		workers = 4
+	}
+	p := WarmProgress{Total: len(cids)}
+	l := &sync.Mutex{}
+	jobs := make(chan string)
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for cid := range jobs {
+				size, fetched, err := m.warmOne(cid, from)
+				l.Lock()
+				p.Done++
+				switch {
+				case err != nil:
+					p.Failed++
+					m.log.WithField("cid", cid).Warn("Could not warm: ", err)
+				case fetched:
+					p.Fetched++
+					p.Bytes += size
+				default:
+					p.Skipped++
+				}
+				p.Duration = time.Since(start)
+				if progress != nil {
+					progress(p)
+				}
+				l.Unlock()
+			}
+		}()
+	}
+	for _, cid := range cids {
+		jobs <- cid
+	}
+	close(jobs)
+	wg.Wait()
+
+	p.Duration = time.Since(start)
+	m.log.WithField("fetched", p.Fetched).
+		WithField("failed", p.Failed).
+		WithField("duration", p.Duration).Info("Cache warming completed")
+	return p
+}
+
+func (m *CacheManager) warmOne(cid string, from string) (int64, bool, error) {
+	key, err := common.CidKey(cid)
+	if err != nil {
+		return 0, false, nil
+	}
+	if m.db.IsBlocked(key) {
+		return 0, false, nil
+	}
+	if existing, err := m.db.GetCache(key); err == nil && existing.Status == "cached" {
+		return 0, false, nil
+	}
+	size, err := m.fetch(cid, from)
+	return size, err == nil, err
+}
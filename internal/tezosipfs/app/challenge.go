@@ -0,0 +1,344 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/common"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/network"
+	"math/big"
+	"time"
+)
+
+/*
+ * Proof-of-storage: we ask a peer that acknowledged a cid for a random
+ * block of its DAG. The peer answers sha256(nonce || block), the fresh
+ * nonce keeps it from replaying old answers. Only the challenged peer
+ * can answer, but nothing stops it from fetching the block on demand,
+ * a passed challenge shows the peer can get the content, not that it
+ * stores it.
+ */
+
+type storageChallenge struct {
+	Peer  string // the challenged peer, everybody else ignores it
+	Cid   string
+	Block string
+	Nonce []byte
+}
+
+// openChallenge waits for the proof of peer
+type openChallenge struct {
+	peer string
+	ch   chan storageProof
+}
+
+type storageProof struct {
+	Nonce []byte
+	Proof []byte `json:",omitempty"`
+	Error string `json:",omitempty"`
+}
+
+type PeerReport struct {
+	common.PeerStats
+	Uptime  float64 // share of checks the peer was online
+	Failing bool    // no longer counts as a replica
+}
+
+var errChallengeTimeout = errors.New("no proof received in time")
+
+func proofOf(nonce []byte, block []byte) []byte {
+	h := sha256.New()
+	h.Write(nonce)
+	h.Write(block)
+	return h.Sum(nil)
+}
+
+func (r *Replicator) challengeLoop() {
+	for {
+		interval := time.Duration(r.c.Replication.Challenges.Interval) * time.Minute
+		if interval <= 0 {
+			interval = time.Hour
+		}
+		time.Sleep(interval)
+		r.challengeRound()
+	}
+}
+
+// challengeRound updates uptime and challenges every live peer once
+func (r *Replicator) challengeRound() {
+	live := r.observe()
+	acked := map[string][]string{}
+	reps, err := r.db.Replications()
+	if err != nil {
+		r.log.Error("Failed to load replications: ", err)
+		return
+	}
+	for _, rep := range reps {
+		acks, _ := r.db.GetPinAcks(rep.Cid)
+		for _, a := range acks {
+			if live[a.Peer] {
+				acked[a.Peer] = append(acked[a.Peer], rep.Cid)
+			}
+		}
+	}
+	for peer, cids := range acked {
+		go r.Challenge(peer, cids[randomIndex(len(cids))])
+	}
+}
+
+// observe counts for every known storage peer whether it is online
+func (r *Replicator) observe() map[string]bool {
+	live := map[string]bool{}
+	for _, p := range r.swarm.PinForUs() {
+		live[p.PeerId] = true
+	}
+	seen := map[string]bool{}
+	all, _ := r.db.AllPeerStats()
+	for i := range all {
+		s := &all[i]
+		seen[s.Peer] = true
+		s.Rounds++
+		if live[s.Peer] {
+			s.Online++
+			s.LastSeen = time.Now()
+		}
+		r.db.SavePeerStats(s)
+	}
+	for peer := range live {
+		if seen[peer] {
+			continue
+		}
+		r.db.SavePeerStats(&common.PeerStats{
+			Peer:      peer,
+			FirstSeen: time.Now(),
+			LastSeen:  time.Now(),
+			Rounds:    1,
+			Online:    1,
+		})
+	}
+	return live
+}
+
+/*
+ * Challenge asks peer to prove it stores a random block of cid. Returns
+ * nil if we could not issue it, our own failures do not count against peer
+ */
+func (r *Replicator) Challenge(peer string, cid string) *common.Challenge {
+	start := time.Now()
+	res := &common.Challenge{
+		Peer:   peer,
+		Cid:    cid,
+		Issued: start,
+	}
+	issued, err := r.challenge(peer, cid, res)
+	if !issued {
+		r.log.WithField("peer", peer).WithField("cid", cid).Warn("Could not issue storage challenge: ", err)
+		return nil
+	}
+	res.Duration = time.Since(start)
+	res.Passed = err == nil
+	if err != nil {
+		res.Error = err.Error()
+		r.log.WithField("peer", peer).WithField("cid", cid).Warn("Storage challenge failed: ", err)
+	} else {
+		r.log.WithField("peer", peer).WithField("cid", cid).Trace("Storage challenge passed")
+	}
+	r.db.SaveChallenge(res)
+	r.recordChallenge(res)
+	return res
+}
+
+// challenge is false if it failed before anything was sent to peer
+func (r *Replicator) challenge(peer string, cid string, res *common.Challenge) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.challengeTimeout())
+	defer cancel()
+	block, err := r.randomBlock(ctx, cid)
+	if err != nil {
+		return false, errors.New("could not pick a block: " + err.Error())
+	}
+	res.Block = block
+	data, err := r.net.GetBlock(ctx, block, false)
+	if err != nil {
+		return false, errors.New("could not fetch block: " + err.Error())
+	}
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return false, err
+	}
+
+	id := hex.EncodeToString(nonce)
+	ch := make(chan storageProof, 1)
+	r.l.Lock()
+	r.pending[id] = &openChallenge{peer: peer, ch: ch}
+	r.l.Unlock()
+	defer func() {
+		r.l.Lock()
+		delete(r.pending, id)
+		r.l.Unlock()
+	}()
+
+	b, _ := json.Marshal(storageChallenge{
+		Peer:  peer,
+		Cid:   cid,
+		Block: block,
+		Nonce: nonce,
+	})
+	sendTo(r.net, r.swarm.FederationsOf(peer), &network.PubSubMessage{
+		Kind: "storage_challenge",
+		Data: b,
+	})
+
+	select {
+	case proof := <-ch:
+		if proof.Error != "" {
+			return true, errors.New(proof.Error)
+		}
+		if !bytes.Equal(proof.Proof, proofOf(nonce, data)) {
+			return true, errors.New("invalid proof")
+		}
+		return true, nil
+	case <-ctx.Done():
+		return true, errChallengeTimeout
+	}
+}
+
+// randomBlock walks down the DAG of cid, stopping at a random depth
+func (r *Replicator) randomBlock(ctx context.Context, cid string) (string, error) {
+	current := cid
+	for depth := 0; depth < 32; depth++ {
+		links, err := r.net.Links(ctx, current)
+		if err != nil {
+			return "", err
+		}
+		// every node on the path has the same chance to be picked as its children
+		i := randomIndex(len(links) + 1)
+		if i == len(links) {
+			break
+		}
+		current = links[i]
+	}
+	return current, nil
+}
+
+func (r *Replicator) recordChallenge(c *common.Challenge) {
+	s, err := r.db.GetPeerStats(c.Peer)
+	if err != nil {
+		s = &common.PeerStats{
+			Peer:      c.Peer,
+			FirstSeen: time.Now(),
+		}
+	}
+	s.LastChallenge = c.Issued
+	if c.Passed {
+		s.Passed++
+		s.ConsecutiveFailures = 0
+		s.LastSeen = time.Now()
+	} else {
+		s.Failed++
+		s.ConsecutiveFailures++
+	}
+	r.db.SavePeerStats(s)
+}
+
+// respond answers challenges addressed to us by peers we pin for in that federation
+func (r *Replicator) respond(msg *network.PubSubMessage) {
+	c := storageChallenge{}
+	if err := json.Unmarshal(msg.Data, &c); err != nil || c.Peer != r.net.ID() {
+		return
+	}
+	if !r.swarm.PinForIn(msg.Network, msg.From) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	proof := storageProof{Nonce: c.Nonce}
+	data, err := r.net.GetBlock(ctx, c.Block, true)
+	if err != nil {
+		proof.Error = "block not stored: " + err.Error()
+	} else {
+		proof.Proof = proofOf(c.Nonce, data)
+	}
+	b, _ := json.Marshal(proof)
+	// answered in the federation that asked
+	r.net.SendMessageTo(msg.Network, &network.PubSubMessage{
+		Kind: "storage_proof",
+		Data: b,
+	})
+}
+
+func (r *Replicator) receiveProof(msg *network.PubSubMessage) {
+	proof := storageProof{}
+	if err := json.Unmarshal(msg.Data, &proof); err != nil {
+		return
+	}
+	r.l.Lock()
+	open, ok := r.pending[hex.EncodeToString(proof.Nonce)]
+	r.l.Unlock()
+	if !ok {
+		return
+	}
+	if open.peer != msg.From {
+		r.log.WithField("peer", msg.From).WithField("challenged", open.peer).Warn("Ignoring proof for a challenge of another peer")
+		return
+	}
+	select {
+	case open.ch <- proof:
+	default:
+	}
+}
+
+func (r *Replicator) challengeTimeout() time.Duration {
+	timeout := time.Duration(r.c.Replication.Challenges.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	return timeout
+}
+
+// Failing is true for peers that failed too many challenges in a row
+func (r *Replicator) Failing(peer string) bool {
+	s, err := r.db.GetPeerStats(peer)
+	if err != nil {
+		return false
+	}
+	return r.failing(s)
+}
+
+func (r *Replicator) failing(s *common.PeerStats) bool {
+	max := r.c.Replication.Challenges.MaxFailures
+	if max <= 0 {
+		max = 3
+	}
+	return s.ConsecutiveFailures >= max
+}
+
+func (r *Replicator) PeerReports() ([]PeerReport, error) {
+	all, err := r.db.AllPeerStats()
+	if err != nil {
+		return nil, err
+	}
+	res := []PeerReport{}
+	for i := range all {
+		report := PeerReport{
+			PeerStats: all[i],
+			Failing:   r.failing(&all[i]),
+		}
+		if all[i].Rounds > 0 {
+			report.Uptime = float64(all[i].Online) / float64(all[i].Rounds)
+		}
+		res = append(res, report)
+	}
+	return res, nil
+}
+
+func randomIndex(n int) int {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0
+	}
+	return int(i.Int64())
+}
@@ -0,0 +1,29 @@
+package app
+
+import (
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/network"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/swarm"
+)
+
+/*
+ * Only advertisements go to every federation. Uploads are announced in the
+ * federations of the peers storing or caching for us, acks, rejections
+ * and challenges go to the federations of the peer they are meant for.
+ */
+
+// sendTo publishes msg in each of networks
+func sendTo(net network.NetworkInterface, networks []string, msg *network.PubSubMessage) {
+	for _, n := range networks {
+		net.SendMessageTo(n, msg)
+	}
+}
+
+// pinningIn is the first federation in which peer pins for us
+func pinningIn(s *swarm.Swarm, peer string) string {
+	for _, n := range s.FederationsOf(peer) {
+		if s.PinsForUs(n, peer) {
+			return n
+		}
+	}
+	return ""
+}
@@ -2,6 +2,7 @@ package app
 
 import (
 	"bytes"
+	"context"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
@@ -29,9 +30,11 @@ type Gateway struct {
 	db             *db.StormDB
 	c              *config.Config
 	pendingUploads map[string]*PendingUpload
+	hot            *hotCounter
+	replicator     *Replicator
 }
 
-func NewGateway(c *config.Config, net network.NetworkInterface, l *logrus.Entry, s *swarm.Swarm, db *db.StormDB) *Gateway {
+func NewGateway(c *config.Config, net network.NetworkInterface, l *logrus.Entry, s *swarm.Swarm, db *db.StormDB, r *Replicator) *Gateway {
 	if !c.GatewayEnabled {
 		l.Info("HTTP Gateway disabled")
 		return nil
@@ -42,6 +45,8 @@ func NewGateway(c *config.Config, net network.NetworkInterface, l *logrus.Entry,
 	g.db = db
 	g.c = c
 	g.pendingUploads = map[string]*PendingUpload{}
+	g.hot = newHotCounter()
+	g.replicator = r
 	g.l = &sync.Mutex{}
 	g.log = l.WithField("source", "gateway")
 	g.port = c.Gateway.Server.Port
@@ -61,6 +66,7 @@ func NewGateway(c *config.Config, net network.NetworkInterface, l *logrus.Entry,
 	g.accessTokens = []config.AccessTokens{}
 	go g.watchConfig(c)
 	go g.autocache()
+	go g.shareHotContent()
 	return &g
 }
 
@@ -87,7 +93,11 @@ func (g *Gateway) Run() {
 	r.POST("/upload/once", g.onceUploadRoute)
 	r.POST("/upload/store_and_cache", g.oncStoreAndCachedUploadRoute)
 	r.POST("/upload/threshold", g.customThreshold)
+	r.POST("/upload/renew/:cid", g.renewRoute)
 	r.GET("/network", g.networkRoute)
+	if g.c.Gateway.Server.CacheIndex {
+		r.GET("/cache/index", g.cacheIndexRoute)
+	}
 	r.Run("0.0.0.0:" + strconv.Itoa(g.port))
 }
 
@@ -101,42 +111,78 @@ func (g *Gateway) ipfsRoute(c *gin.Context) {
 	headers := map[string]string{
 		"Cache-Control": "max-age=86400", // cache for one day, ipfs content never changes
 	}
-	if len(cid) <= 12 || len(cid) >= 64 {
-		c.String(500, "invalid cid")
+	// v0 and v1 cids of the same content share one cache object
+	key, err := common.CidKey(cid)
+	if err != nil {
+		c.String(400, "invalid cid: "+err.Error())
 		return
 	}
 
-	if g.db.IsBlocked(cid) {
+	if g.db.IsBlocked(key) {
 		c.String(404, "not found")
 		return
 	}
-	l, reader, err := g.cache.GetFile(cid)
+	if g.c.Gateway.HotContent.Share {
+		g.hot.hit(key, cid)
+	}
+	if g.c.Gateway.Redirect.Enabled && g.redirect(c, key) {
+		g.log.WithField("cid", cid).Trace("Cache hit, redirected")
+		return
+	}
+	var buf []byte
+	l, reader, err := g.cache.GetFile(key)
+	if err == nil || err == cache.ErrUnverifiable {
+		buf, _ = ioutil.ReadAll(reader)
+		switch {
+		case err != nil:
+			// serve it, refetching would not help
+			g.unverifiable(key, len(buf), err)
+			err = nil
+		case g.c.Gateway.Redirect.Enabled && g.c.Gateway.Storage.Verify:
+			// record the check, so later requests can be redirected
+			g.passed(key, len(buf))
+		case g.c.Gateway.Redirect.Enabled:
+			err = g.check(key, buf)
+		}
+	}
 	if err == nil {
 		g.log.WithField("cid", cid).Trace("Cache hit")
-		buf, _ := ioutil.ReadAll(reader)
 		c.DataFromReader(200, l, getType(buf), bytes.NewReader(buf), headers)
 		return
 	}
+	if err == cache.ErrIntegrity {
+		// got quarantined, fetch a fresh copy below
+		g.db.SaveScrubResult(&common.ScrubResult{
+			Cid:     key,
+			Checked: time.Now(),
+			Status:  "mismatch",
+		})
+	}
+	// fetch by the requested cid, the codec matters for the network
 	reader, err = g.net.GetFile(c, cid)
 	if err != nil {
 		c.String(404, ":(")
 		return
 	}
 	g.log.WithField("cid", cid).Trace("Found via Network")
-	buf, _ := ioutil.ReadAll(reader)
-	g.cache.StoreFile(cid, bytes.NewReader(buf))
-	// save a record in db for future use
-	cacheEntry := common.Cache{
-		Created: time.Now(),
-		Cid:     cid,
-		From:    "gateway",
-		Status:  "cached",
-		Size:    int64(len(buf)),
-	}
-	g.db.SaveCache(&cacheEntry)
+	buf, _ = ioutil.ReadAll(reader)
+	g.storeInCache(key, cid, buf, "gateway")
 	c.DataFromReader(200, int64(len(buf)), getType(buf), bytes.NewReader(buf), headers)
 }
 
+// cacheIndexRoute lists everything we have cached, so new gateways can warm up from us
+func (g *Gateway) cacheIndexRoute(c *gin.Context) {
+	if g.checkAccessToken(c) {
+		return
+	}
+	cids, err := g.db.CachedCids()
+	if err != nil {
+		c.String(500, err.Error())
+		return
+	}
+	c.JSON(200, cids)
+}
+
 func (g *Gateway) networkRoute(c *gin.Context) {
 	if g.checkAccessToken(c) {
 		return
@@ -220,6 +266,10 @@ outer:
 				check.res.Status = "Success"
 				check.lock.Unlock()
 				break outer
+			} else if check.unreachable(1) {
+				check.res.Status = "Rejected"
+				check.lock.Unlock()
+				break outer
 			} else {
 				check.lock.Unlock()
 			}
@@ -229,7 +279,7 @@ outer:
 	check.lock.Lock()
 	defer check.lock.Unlock()
 	c.JSON(200, check.res)
-	delete(g.pendingUploads, check.res.Cid)
+	g.finishUpload(check)
 }
 
 /*
@@ -262,6 +312,11 @@ outer:
 				check.lock.Unlock()
 				break outer
 			}
+			if check.unreachable(1) {
+				check.res.Status = "Rejected"
+				check.lock.Unlock()
+				break outer
+			}
 			check.lock.Unlock()
 
 		}
@@ -270,7 +325,7 @@ outer:
 	check.lock.Lock()
 	defer check.lock.Unlock()
 	c.JSON(200, check.res)
-	delete(g.pendingUploads, check.res.Cid)
+	g.finishUpload(check)
 }
 
 /*
@@ -307,6 +362,11 @@ outer:
 				check.lock.Unlock()
 				break outer
 			}
+			if check.unreachable(MustStore) {
+				check.res.Status = "Rejected"
+				check.lock.Unlock()
+				break outer
+			}
 			check.lock.Unlock()
 
 		}
@@ -315,7 +375,7 @@ outer:
 	check.lock.Lock()
 	defer check.lock.Unlock()
 	c.JSON(200, check.res)
-	delete(g.pendingUploads, check.res.Cid)
+	g.finishUpload(check)
 }
 
 func (g *Gateway) prepareGuaranteedUpload(c *gin.Context) (*PendingUpload, *time.Ticker, bool) {
@@ -337,21 +397,51 @@ func (g *Gateway) prepareGuaranteedUpload(c *gin.Context) (*PendingUpload, *time
 	}
 	net.NumberCached = intptr(0)
 	net.NumberStored = intptr(0)
+	net.NumberRejected = intptr(0)
 
 	notify := make(chan struct{})
 	check := &PendingUpload{
 		lock:   &sync.Mutex{},
 		res:    &net,
 		Notify: notify,
+		seen:   map[string]bool{},
+		done:   make(chan struct{}),
 	}
 
-	cid, done := g.storeFile(c)
+	req, done := g.uploadFile(c)
 	if done {
 		return nil, nil, true
 	}
 
-	check.res.Cid = cid
-	g.pendingUploads[cid] = check
+	key, err := common.CidKey(req.Cid)
+	if err != nil {
+		c.String(500, err.Error())
+		return nil, nil, true
+	}
+	check.res.Cid = req.Cid
+	check.ID = key
+	// register before asking anyone, so no ack gets lost
+	g.l.Lock()
+	g.pendingUploads[key] = check
+	g.l.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout_duration)
+	check.cancel = cancel
+	// tracked first, so acks of fast storage nodes count
+	g.track(c, req)
+	fallback := g.requestPins(ctx, check, req)
+	// caches still need the announcement, storage nodes only if they missed the stream
+	req.Direct = true
+	req.Fallback = fallback
+	sendTo(g.net, g.swarm.ForUsIn(), req.ToTransportFormat())
 	ticker := time.NewTicker(timeout_duration)
 	return check, ticker, false
 }
+
+// finishUpload stops waiting for acks of check
+func (g *Gateway) finishUpload(check *PendingUpload) {
+	close(check.done)
+	check.cancel()
+	g.l.Lock()
+	delete(g.pendingUploads, check.ID)
+	g.l.Unlock()
+}
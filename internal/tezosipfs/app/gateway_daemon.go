@@ -1,16 +1,23 @@
 package app
 
 import (
+	"context"
+	"encoding/json"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/common"
 	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/config"
 	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/network"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/swarm"
+	"sync"
+	"time"
 )
 
-func (g *Gateway) broadcastCache(cid string) {
+// broadcastCache tells from that we cached cid, in the federations of from
+func (g *Gateway) broadcastCache(cid string, from string) {
 	msg := network.PubSubMessage{
 		Kind: "cached",
 		Data: []byte(cid),
 	}
-	g.net.SendMessage(&msg)
+	sendTo(g.net, g.swarm.FederationsOf(from), &msg)
 }
 
 func (g *Gateway) watchConfig(c *config.Config) {
@@ -26,51 +33,153 @@ func (g *Gateway) watchConfig(c *config.Config) {
 }
 
 func (g *Gateway) autocache() {
-	ch := g.net.Subscribe()
-	for {
-		msg := <-ch
-		if msg.Kind == "new_object" && g.swarm.CacheFor(msg.From) {
-			g.log.WithField("source", msg.From).WithField("cid", string(msg.Data)).Trace("pin request")
-			if g.swarm.CacheFor(msg.From) {
-				g.log.WithField("cid", string(msg.Data)).WithField("origin", msg.From).Info("Auto-cache")
-				go g.cacheFile(string(msg.Data))
+	// caching is best effort, we rather miss a request than hold up others
+	sub := g.net.Events().Subscribe(network.SubscribeOptions{
+		Name:  "gateway_autocache",
+		Kinds: []string{"new_object", "hot_cids"},
+	})
+	for msg := range sub.C {
+		if msg.Kind == "new_object" && g.swarm.CacheForIn(msg.Network, msg.From) {
+			req, err := swarm.ParsePinRequest(msg.Data)
+			if err != nil {
+				continue
+			}
+			g.log.WithField("source", msg.From).WithField("cid", req.Cid).Trace("pin request")
+			if g.swarm.CacheForIn(msg.Network, msg.From) {
+				g.log.WithField("cid", req.Cid).WithField("origin", msg.From).Info("Auto-cache")
+				if len(req.Data) > 0 {
+					go g.cacheInline(req, msg.From)
+				} else {
+					go g.cacheFile(req.Cid, msg.From)
+				}
 			}
 		}
+		if msg.Kind == "hot_cids" && g.c.Gateway.HotContent.Prefetch && g.swarm.CacheForIn(msg.Network, msg.From) {
+			go g.prefetchHotContent(msg)
+		}
 	}
 }
 
 func (g *Gateway) listen() {
-	ch := g.net.Subscribe()
-	for {
-		msg := <-ch
+	sub := g.net.Events().Subscribe(network.SubscribeOptions{
+		Name:   "gateway",
+		Kinds:  []string{"cached", "pin_rejected", "pinned"},
+		Buffer: 256,
+		Policy: network.Block,
+	})
+	for msg := range sub.C {
 		if msg.Kind == "cached" {
-			cid := string(msg.Data)
-			if val, ok := g.pendingUploads[cid]; ok {
-				val.lock.Lock()
-				*val.res.NumberCached++
-				for i, _ := range val.res.CacheNodes {
-					if val.res.CacheNodes[i].PeerId == msg.From {
-						val.res.CacheNodes[i].Cached = true
-					}
-				}
-				val.lock.Unlock()
-				val.Notify <- struct{}{}
+			cid, err := common.CidKey(string(msg.Data))
+			if err != nil {
+				continue
+			}
+			if val, ok := g.pending(cid); ok && g.swarm.CachesForUs(msg.Network, msg.From) {
+				go val.cached(msg.From)
 			}
 		}
+		if msg.Kind == "pin_rejected" {
+			g.rejected(msg)
+		}
 		if msg.Kind == "pinned" {
-			cid := string(msg.Data)
-			if val, ok := g.pendingUploads[cid]; ok {
-				val.lock.Lock()
-				*val.res.NumberStored++
-				for i, _ := range val.res.StorageNodes {
-					if val.res.StorageNodes[i].PeerId == msg.From {
-						val.res.StorageNodes[i].Stored = true
+			cid, err := common.CidKey(string(msg.Data))
+			if err != nil {
+				continue
+			}
+			if g.replicator.Failing(msg.From) {
+				g.log.WithField("peer", msg.From).Trace("ignoring ack of peer failing storage challenges")
+				continue
+			}
+			if val, ok := g.pending(cid); ok && g.swarm.PinsForUs(msg.Network, msg.From) {
+				go val.stored(msg.From)
+			}
+		}
+	}
+}
+
+// rejected counts storage nodes that refused to pin one of our pending uploads
+func (g *Gateway) rejected(msg *network.PubSubMessage) {
+	r := swarm.PinRejection{}
+	if err := json.Unmarshal(msg.Data, &r); err != nil || r.Origin != g.net.ID() {
+		return
+	}
+	cid, err := common.CidKey(r.Cid)
+	if err != nil {
+		return
+	}
+	val, ok := g.pending(cid)
+	if !ok || !g.swarm.PinsForUs(msg.Network, msg.From) {
+		return
+	}
+	g.log.WithField("cid", r.Cid).WithField("peer", msg.From).Warn("Storage node refused to pin: ", r.Reason)
+	go val.refused(msg.From, r.Reason)
+}
+
+/*
+ * requestPins asks every storage node directly and returns the ones that
+ * did not answer in time, those need the pin request via pubsub
+ */
+func (g *Gateway) requestPins(ctx context.Context, check *PendingUpload, req *swarm.PinRequest) []string {
+	type reach struct {
+		peer string
+		ok   bool
+	}
+	reached := make(chan reach, len(check.res.StorageNodes))
+	for _, node := range check.res.StorageNodes {
+		go func(peer string) {
+			once := sync.Once{}
+			err := requestPin(ctx, g.net, peer, pinningIn(g.swarm, peer), req, func(ack *swarm.PinAck) {
+				once.Do(func() { reached <- reach{peer, true} })
+				switch ack.Status {
+				case "pinned":
+					// acks come over the stream only, the replicator does not see them
+					g.replicator.recordAck(req.Cid, peer)
+					if !g.replicator.Failing(peer) {
+						check.stored(peer)
 					}
+				case "rejected", "failed":
+					g.log.WithField("cid", req.Cid).WithField("peer", peer).Warn("Storage node did not pin: ", ack.Error)
+					check.refused(peer, ack.Error)
 				}
-				val.lock.Unlock()
-				val.Notify <- struct{}{}
+			})
+			once.Do(func() { reached <- reach{peer, false} })
+			if err != nil && ctx.Err() == nil {
+				g.log.WithField("peer", peer).Trace("no direct pin request, relying on pubsub: ", err)
+			}
+		}(node.PeerId)
+	}
 
+	waiting := map[string]bool{}
+	for _, node := range check.res.StorageNodes {
+		waiting[node.PeerId] = true
+	}
+	timeout := time.NewTimer(pinStreamConnectTimeout)
+	defer timeout.Stop()
+	fallback := []string{}
+	for len(waiting) > 0 {
+		select {
+		case r := <-reached:
+			delete(waiting, r.peer)
+			if !r.ok {
+				fallback = append(fallback, r.peer)
+			}
+		case <-timeout.C:
+			for peer := range waiting {
+				fallback = append(fallback, peer)
 			}
+			return fallback
+		case <-ctx.Done():
+			for peer := range waiting {
+				fallback = append(fallback, peer)
+			}
+			return fallback
 		}
 	}
+	return fallback
+}
+
+func (g *Gateway) pending(key string) (*PendingUpload, bool) {
+	g.l.Lock()
+	defer g.l.Unlock()
+	val, ok := g.pendingUploads[key]
+	return val, ok
 }
@@ -4,26 +4,61 @@ import (
 	"bytes"
 	"context"
 	"github.com/gin-gonic/gin"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/cache"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/common"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/swarm"
+	"io"
 	"io/ioutil"
+	"strconv"
 	"sync"
+	"time"
 )
 
-func (g *Gateway) cacheFile(cid string) {
+func (g *Gateway) cacheFile(cid string, from string) {
+	key, err := common.CidKey(cid)
+	if err != nil {
+		g.log.WithField("cid", cid).Warn("refusing to cache invalid cid: ", err)
+		return
+	}
+	if g.db.IsBlocked(key) {
+		g.log.WithField("cid", cid).Info("not caching blocked content")
+		return
+	}
 	reader, err := g.net.GetFile(context.Background(), cid)
 	if err != nil {
 		g.log.Error(err)
+		return
 	}
 	// todo split reader if possible
 	buf, _ := ioutil.ReadAll(reader)
 	if g.cache != nil {
-		g.cache.StoreFile(cid, bytes.NewReader(buf))
+		if err := g.storeInCache(key, cid, buf, from); err != nil {
+			g.log.WithField("cid", cid).Error("Failed to cache: ", err)
+			return
+		}
 		g.log.WithField("cid", cid).Trace("Stored in cache")
-		g.broadcastCache(cid)
+		g.broadcastCache(cid, from)
 	} else {
 		g.log.WithField("cid", cid).Error("got cache request, but have no cache configured...")
 	}
 }
 
+// storeInCache only records what actually made it into the bucket
+func (g *Gateway) storeInCache(key string, cid string, buf []byte, from string) error {
+	err := g.cache.StoreFile(key, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	return g.db.SaveCache(&common.Cache{
+		Created:  time.Now(),
+		Cid:      key,
+		Original: common.Original(cid, key),
+		From:     from,
+		Status:   "cached",
+		Size:     int64(len(buf)),
+	})
+}
+
 func (g *Gateway) checkAccessToken(c *gin.Context) bool {
 	if len(g.accessTokens) != 0 {
 		tokenH := c.Request.Header["Token"]
@@ -69,34 +104,110 @@ func (g *Gateway) checkUploadToken(c *gin.Context) bool {
 }
 
 func (g *Gateway) storeFile(c *gin.Context) (string, bool) {
+	req, done := g.uploadFile(c)
+	if done {
+		return "", true
+	}
+	g.announce(c, req)
+	return req.Cid, false
+}
+
+// uploadFile adds the posted file to our node, the request is not announced yet
+func (g *Gateway) uploadFile(c *gin.Context) (*swarm.PinRequest, bool) {
 	file, err := c.FormFile("file")
 	if err != nil {
 		c.String(500, err.Error())
-		return "", true
+		return nil, true
+	}
+
+	expires, err := parseLease(c.PostForm("expires"), c.PostForm("lease"))
+	if err != nil {
+		c.String(400, err.Error())
+		return nil, true
 	}
 
 	f, err := file.Open()
 	if err != nil {
 		c.String(500, err.Error())
-		return "", true
+		return nil, true
+	}
+	defer f.Close()
+	var data []byte
+	var content io.Reader = f
+	if inline := int64(g.c.Gateway.Uploads.InlineSize) * 1024; inline > 0 && file.Size <= inline && file.Size <= maxInlineSize {
+		// small enough to send along, receivers then need no fetch
+		data, err = ioutil.ReadAll(f)
+		if err != nil {
+			c.String(500, err.Error())
+			return nil, true
+		}
+		content = bytes.NewReader(data)
 	}
-	cid, err := g.net.UploadAndPin(f)
+	cid, err := g.net.UploadAndPin(content)
 	if err != nil {
 		c.String(500, err.Error())
-		return "", true
+		return nil, true
+	}
+	return &swarm.PinRequest{
+		Cid:     cid,
+		Expires: expires,
+		Data:    data,
+	}, false
+}
+
+// announce sends the pin request to caches and storage nodes, in the federations they serve us in
+func (g *Gateway) announce(c *gin.Context, req *swarm.PinRequest) {
+	g.track(c, req)
+	sendTo(g.net, g.swarm.ForUsIn(), req.ToTransportFormat())
+	g.log.WithField("cid", req.Cid).Trace("sending pin request")
+}
+
+// track keeps count of the copies of content we announce
+func (g *Gateway) track(c *gin.Context, req *swarm.PinRequest) {
+	replicas, _ := strconv.Atoi(c.PostForm("replicas"))
+	if err := g.replicator.Track(req.Cid, replicas, req.Expires); err != nil {
+		g.log.WithField("cid", req.Cid).Warn("Could not track replication: ", err)
 	}
-	return cid, false
+}
+
+// renewRoute extends the lease of content we uploaded and announces it again
+func (g *Gateway) renewRoute(c *gin.Context) {
+	if g.checkUploadToken(c) {
+		return
+	}
+	cid := c.Param("cid")
+	key, err := common.CidKey(cid)
+	if err != nil {
+		c.String(400, "invalid cid: "+err.Error())
+		return
+	}
+	expires, err := parseLease(c.PostForm("expires"), c.PostForm("lease"))
+	if err != nil {
+		c.String(400, err.Error())
+		return
+	}
+	if err := g.replicator.Renew(key, expires); err != nil {
+		c.String(404, "unknown cid")
+		return
+	}
+	req := swarm.PinRequest{
+		Cid:     cid,
+		Expires: expires,
+	}
+	sendTo(g.net, g.swarm.ForUsIn(), req.ToTransportFormat())
+	c.String(200, "ok")
 }
 
 type UploadResponse struct {
-	Cid          string        `json:",omitempty"`
-	CacheNodes   []CacheNode   `json:",omitempty"`
-	StorageNodes []StorageNode `json:",omitempty"`
-	NumberCaches *int          `json:",omitempty"`
-	NumberStores *int          `json:",omitempty"`
-	NumberCached *int          `json:",omitempty"`
-	NumberStored *int          `json:",omitempty"`
-	Status       string        `json:",omitempty"`
+	Cid            string        `json:",omitempty"`
+	CacheNodes     []CacheNode   `json:",omitempty"`
+	StorageNodes   []StorageNode `json:",omitempty"`
+	NumberCaches   *int          `json:",omitempty"`
+	NumberStores   *int          `json:",omitempty"`
+	NumberCached   *int          `json:",omitempty"`
+	NumberStored   *int          `json:",omitempty"`
+	NumberRejected *int          `json:",omitempty"` // storage nodes that refused, e.g. over quota
+	Status         string        `json:",omitempty"`
 }
 
 type StorageNode struct {
@@ -106,6 +217,7 @@ type StorageNode struct {
 	Comment      string `json:",omitempty"`
 	PeerId       string `json:",omitempty"`
 	Stored       bool   `json:",omitempty"`
+	Rejected     string `json:",omitempty"` // reason the node refused to store
 }
 
 type CacheNode struct {
@@ -122,11 +234,83 @@ type PendingUpload struct {
 	Notify chan struct{}
 	lock   *sync.Mutex
 	res    *UploadResponse
+	seen   map[string]bool // acks we counted, pubsub and streams may both deliver one
+	done   chan struct{}
+	cancel context.CancelFunc
+}
+
+// stored counts the first pin ack of peer
+func (p *PendingUpload) stored(peer string) {
+	if !p.first("stored/" + peer) {
+		return
+	}
+	p.lock.Lock()
+	*p.res.NumberStored++
+	for i := range p.res.StorageNodes {
+		if p.res.StorageNodes[i].PeerId == peer {
+			p.res.StorageNodes[i].Stored = true
+		}
+	}
+	p.lock.Unlock()
+	p.notify()
+}
+
+// cached counts the first cache ack of peer
+func (p *PendingUpload) cached(peer string) {
+	if !p.first("cached/" + peer) {
+		return
+	}
+	p.lock.Lock()
+	*p.res.NumberCached++
+	for i := range p.res.CacheNodes {
+		if p.res.CacheNodes[i].PeerId == peer {
+			p.res.CacheNodes[i].Cached = true
+		}
+	}
+	p.lock.Unlock()
+	p.notify()
+}
+
+// refused counts a storage node that will not store the upload
+func (p *PendingUpload) refused(peer string, reason string) {
+	if !p.first("refused/" + peer) {
+		return
+	}
+	p.lock.Lock()
+	*p.res.NumberRejected++
+	for i := range p.res.StorageNodes {
+		if p.res.StorageNodes[i].PeerId == peer {
+			p.res.StorageNodes[i].Rejected = reason
+		}
+	}
+	p.lock.Unlock()
+	p.notify()
+}
+
+func (p *PendingUpload) first(ack string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.seen[ack] {
+		return false
+	}
+	p.seen[ack] = true
+	return true
+}
+
+func (p *PendingUpload) notify() {
+	select {
+	case p.Notify <- struct{}{}:
+	case <-p.done:
+	}
+}
+
+// unreachable is true once too many storage nodes refused to store must copies, needs lock
+func (p *PendingUpload) unreachable(must int) bool {
+	return *p.res.NumberStores-*p.res.NumberRejected < must
 }
 
 func getType(buf []byte) string {
-	// TODO
-	return ""
+	return cache.DetectType(buf)
 }
 
 func intptr(i int) *int {
@@ -0,0 +1,104 @@
+package app
+
+import (
+	"encoding/json"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/common"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/network"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+ * hotCounter counts requests per key between two
+ * broadcasts of our most requested content
+ */
+type hotCounter struct {
+	l    *sync.Mutex
+	hits map[string]int
+	cids map[string]string // last requested cid of a key
+}
+
+func newHotCounter() *hotCounter {
+	return &hotCounter{
+		l:    &sync.Mutex{},
+		hits: map[string]int{},
+		cids: map[string]string{},
+	}
+}
+
+func (h *hotCounter) hit(key string, cid string) {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.hits[key]++
+	h.cids[key] = cid
+}
+
+// top returns the n most requested cids and starts counting from zero
+func (h *hotCounter) top(n int) []string {
+	h.l.Lock()
+	hits, cids := h.hits, h.cids
+	h.hits = map[string]int{}
+	h.cids = map[string]string{}
+	h.l.Unlock()
+
+	res := make([]string, 0, len(hits))
+	for k := range hits {
+		res = append(res, k)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return hits[res[i]] > hits[res[j]]
+	})
+	if len(res) > n {
+		res = res[:n]
+	}
+	for i, key := range res {
+		res[i] = cids[key]
+	}
+	return res
+}
+
+func (g *Gateway) shareHotContent() {
+	for {
+		interval := time.Duration(g.c.Gateway.HotContent.Interval) * time.Minute
+		if interval <= 0 {
+			interval = 10 * time.Minute
+		}
+		time.Sleep(interval)
+		n := g.c.Gateway.HotContent.TopN
+		if n <= 0 {
+			n = 100
+		}
+		// always, so the counter never outgrows one interval
+		top := g.hot.top(n)
+		if !g.c.Gateway.HotContent.Share || len(top) == 0 {
+			continue
+		}
+		b, _ := json.Marshal(top)
+		sendTo(g.net, g.swarm.ForUsIn(), &network.PubSubMessage{
+			Kind: "hot_cids",
+			Data: b,
+		})
+		g.log.WithField("count", len(top)).Trace("shared hot content")
+	}
+}
+
+// prefetchHotContent caches what a peer we cache for reports as popular
+func (g *Gateway) prefetchHotContent(msg *network.PubSubMessage) {
+	cids := []string{}
+	if err := json.Unmarshal(msg.Data, &cids); err != nil {
+		g.log.WithField("origin", msg.From).Warn("invalid hot_cids message")
+		return
+	}
+	for _, cid := range cids {
+		key, err := common.CidKey(cid)
+		if err != nil {
+			continue
+		}
+		if existing, err := g.db.GetCache(key); err == nil && existing.Status == "cached" {
+			continue
+		}
+		g.log.WithField("cid", cid).WithField("origin", msg.From).Trace("prefetching hot content")
+		g.cacheFile(cid, msg.From)
+	}
+}
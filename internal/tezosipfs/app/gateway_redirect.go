@@ -0,0 +1,120 @@
+package app
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/cache"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/common"
+	"strings"
+	"time"
+)
+
+/*
+ * redirect answers a cache hit with a 302 to a presigned bucket url
+ * or the configured cdn, so the bytes never go through the gateway.
+ * Returns false on a cache miss or if the object was not verified
+ * recently, the caller then serves the file itself.
+ */
+func (g *Gateway) redirect(c *gin.Context, key string) bool {
+	presigner, ok := g.cache.(cache.Presigner)
+	if !ok || !g.verified(key) {
+		return false
+	}
+	_, contentType, err := presigner.Stat(key)
+	if err != nil {
+		return false
+	}
+
+	conf := g.c.Gateway.Redirect
+	if conf.CDN != "" {
+		// the cdn serves the type stored with the object
+		c.Header("Cache-Control", "max-age=86400")
+		c.Redirect(302, strings.TrimRight(conf.CDN, "/")+"/"+key)
+		return true
+	}
+
+	expiry := time.Duration(conf.Expiry) * time.Second
+	if expiry <= 0 {
+		expiry = 5 * time.Minute
+	}
+	url, err := presigner.PresignGet(key, expiry, contentType, contentDisposition(c))
+	if err != nil {
+		g.log.WithField("cid", key).Error("Failed to presign url: ", err)
+		return false
+	}
+	// the url expires, so the redirect must not be cached
+	c.Header("Cache-Control", "no-store")
+	c.Redirect(302, url)
+	return true
+}
+
+// verified is true if key passed a scrub or a check on read within ScrubAge
+func (g *Gateway) verified(key string) bool {
+	r, err := g.db.GetScrubResult(key)
+	if err != nil || r.Status != "ok" {
+		return false
+	}
+	age := time.Duration(g.c.Gateway.Redirect.ScrubAge) * time.Hour
+	if age <= 0 {
+		age = 2 * time.Duration(g.c.Gateway.Storage.Scrub.Interval) * time.Hour
+	}
+	if age <= 0 {
+		age = 48 * time.Hour
+	}
+	return time.Since(r.Checked) < age
+}
+
+/*
+ * check verifies an object served by the gateway, a pass is recorded so
+ * the next request can be redirected. Mismatches are quarantined.
+ */
+func (g *Gateway) check(key string, buf []byte) error {
+	ok, err := cache.Verify(key, buf)
+	if err != nil {
+		// can not tell, serve it but keep redirecting off
+		g.log.WithField("cid", key).Warn("Could not verify cached object: ", err)
+		g.unverifiable(key, len(buf), err)
+		return nil
+	}
+	if !ok {
+		g.log.WithField("cid", key).Error("cached content does not match cid, quarantining")
+		if q, ok := g.cache.(interface{ Quarantine(string) error }); ok {
+			q.Quarantine(key)
+		}
+		return cache.ErrIntegrity
+	}
+	g.passed(key, len(buf))
+	return nil
+}
+
+func (g *Gateway) passed(key string, size int) {
+	g.db.SaveScrubResult(&common.ScrubResult{
+		Cid:     key,
+		Checked: time.Now(),
+		Status:  "ok",
+		Size:    int64(size),
+	})
+}
+
+// unverifiable records objects we could not check, they show up as scrub errors
+func (g *Gateway) unverifiable(key string, size int, err error) {
+	g.db.SaveScrubResult(&common.ScrubResult{
+		Cid:     key,
+		Checked: time.Now(),
+		Status:  "error",
+		Size:    int64(size),
+		Error:   err.Error(),
+	})
+}
+
+// contentDisposition builds the header from the ?filename= and ?download= query params
+func contentDisposition(c *gin.Context) string {
+	disposition := "inline"
+	if c.Query("download") == "true" {
+		disposition = "attachment"
+	}
+	filename := strings.NewReplacer("\"", "", "\\", "", "\r", "", "\n", "").Replace(c.Query("filename"))
+	if filename != "" {
+		disposition += "; filename=\"" + filename + "\""
+	}
+	return disposition
+}
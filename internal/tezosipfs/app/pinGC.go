@@ -0,0 +1,109 @@
+package app
+
+import (
+	"context"
+	"time"
+)
+
+type GCReport struct {
+	Started  time.Time
+	Expired  int // leases that ended before the grace period
+	Removed  int // unpinned from the backend
+	Errors   int
+	Cids     []string // removed, or would be removed in dryRun
+	DryRun   bool
+	Duration time.Duration
+}
+
+func (pin *PinManager) gcLoop() {
+	for {
+		interval := time.Duration(pin.c.PinManager.GC.Interval) * time.Minute
+		if interval <= 0 {
+			interval = time.Hour
+		}
+		time.Sleep(interval)
+		pin.GC(false)
+	}
+}
+
+func (pin *PinManager) gracePeriod() time.Duration {
+	if pin.c.PinManager.GC.GracePeriod < 0 {
+		return 0
+	}
+	if pin.c.PinManager.GC.GracePeriod == 0 {
+		return 24 * time.Hour
+	}
+	return time.Duration(pin.c.PinManager.GC.GracePeriod) * time.Hour
+}
+
+/*
+ * GC unpins content whose lease ended more than the grace period ago
+ * and runs the garbage collector of the backend afterwards.
+ * In dryRun mode it only reports what would be removed.
+ */
+func (pin *PinManager) GC(dryRun bool) *GCReport {
+	report := &GCReport{
+		Started: time.Now(),
+		Cids:    []string{},
+		DryRun:  dryRun,
+	}
+	expired, err := pin.db.ExpiredPins(time.Now().Add(-pin.gracePeriod()))
+	if err != nil {
+		pin.log.Error("Failed to load expired pins: ", err)
+		report.Errors++
+		return report
+	}
+	for i := range expired {
+		p := &expired[i]
+		if p.Status == "expired" || p.Status == "blocked" || p.Status == "removed" {
+			continue
+		}
+		if pin.queue.State(p.Cid) != "" {
+			// a worker still pins it, it is unpinned on the next run
+			continue
+		}
+		report.Expired++
+		report.Cids = append(report.Cids, p.Cid)
+		if dryRun {
+			continue
+		}
+		if p.Status == "pinned" {
+			if err := pin.net.RemovePin(p.Ref()); err != nil {
+				pin.log.WithField("cid", p.Cid).Warn("Could not remove expired pin: ", err)
+				report.Errors++
+				continue
+			}
+			report.Removed++
+		}
+		p.Status = "expired"
+		pin.db.SavePin(p)
+		pin.unreplicate(p.Cid)
+		pin.log.WithField("cid", p.Cid).WithField("expires", p.Expires).Info("Lease expired, unpinned")
+	}
+	if report.Removed > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+		if err := pin.net.GC(ctx); err != nil {
+			pin.log.Error("Backend garbage collection failed: ", err)
+			report.Errors++
+		}
+		cancel()
+	}
+	report.Duration = time.Since(report.Started)
+	pin.log.WithField("expired", report.Expired).
+		WithField("removed", report.Removed).
+		WithField("errors", report.Errors).
+		WithField("dry_run", dryRun).Info("Pin garbage collection completed")
+	if !dryRun {
+		pin.l.Lock()
+		pin.lastGC = report
+		pin.l.Unlock()
+	}
+	return report
+}
+
+// LastGC is the report of the last run that was not a dry run, nil if none
+func (pin *PinManager) LastGC() *GCReport {
+	pin.l.Lock()
+	defer pin.l.Unlock()
+	return pin.lastGC
+}
@@ -0,0 +1,84 @@
+package app
+
+import (
+	"bytes"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/cache"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/common"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/swarm"
+)
+
+/*
+ * Small uploads carry their bytes in PinRequest.Data. Receivers check
+ * that the bytes hash to the cid and use them instead of fetching the
+ * content over bitswap, anything that does not match is fetched as usual.
+ */
+
+// maxInlineSize caps what we accept inline, whatever the sender configured.
+// Base64 in json grows it by a third, this keeps messages below the 1MB pubsub limit
+const maxInlineSize = 512 << 10
+
+// verifyInline returns the key of req if Data is the content of its cid
+func verifyInline(req *swarm.PinRequest) (string, bool) {
+	if len(req.Data) == 0 || len(req.Data) > maxInlineSize {
+		return "", false
+	}
+	key, err := common.CidKey(req.Cid)
+	if err != nil {
+		return "", false
+	}
+	ok, err := cache.Verify(req.Cid, req.Data)
+	if err != nil || !ok {
+		return "", false
+	}
+	return key, true
+}
+
+// importInline adds the inline data to our node, so pinning it needs no fetch
+func (pin *PinManager) importInline(req *swarm.PinRequest, from string) {
+	if len(req.Data) == 0 {
+		return
+	}
+	key, ok := verifyInline(req)
+	if !ok {
+		pin.log.WithField("cid", req.Cid).WithField("origin", from).Warn("inline data does not match the cid, fetching it")
+		return
+	}
+	if pin.db.IsBlocked(key) {
+		return
+	}
+	cid, err := pin.net.Import(bytes.NewReader(req.Data))
+	if err != nil {
+		pin.log.WithField("cid", req.Cid).Warn("Could not import inline data: ", err)
+		return
+	}
+	if imported, _ := common.CidKey(cid); imported != key {
+		// same bytes, different layout, e.g. raw leaves
+		pin.log.WithField("cid", req.Cid).Trace("inline data imports to ", cid, ", fetching it")
+		return
+	}
+	pin.log.WithField("cid", req.Cid).WithField("size", len(req.Data)).Trace("Imported inline data")
+}
+
+// cacheInline caches verified inline data without fetching it
+func (g *Gateway) cacheInline(req *swarm.PinRequest, from string) {
+	key, ok := verifyInline(req)
+	if !ok {
+		g.log.WithField("cid", req.Cid).WithField("origin", from).Warn("inline data does not match the cid, fetching it")
+		g.cacheFile(req.Cid, from)
+		return
+	}
+	if g.db.IsBlocked(key) {
+		g.log.WithField("cid", req.Cid).Info("not caching blocked content")
+		return
+	}
+	if g.cache == nil {
+		g.log.WithField("cid", req.Cid).Error("got cache request, but have no cache configured...")
+		return
+	}
+	if err := g.storeInCache(key, req.Cid, req.Data, from); err != nil {
+		g.log.WithField("cid", req.Cid).Error("Failed to cache: ", err)
+		return
+	}
+	g.log.WithField("cid", req.Cid).Trace("Stored inline data in cache")
+	g.broadcastCache(req.Cid, from)
+}
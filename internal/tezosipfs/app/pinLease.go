@@ -0,0 +1,49 @@
+package app
+
+import (
+	"errors"
+	"time"
+)
+
+/*
+ * Leases: on the wire and in the queue a nil expiry is permanent,
+ * in the db a zero time is. See common.LaterLease for how two
+ * requests for the same content are merged.
+ */
+
+func leaseTime(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
+
+func leasePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// parseLease reads an expiry (RFC3339) or a lease duration (e.g. 720h), empty is permanent
+func parseLease(expires string, lease string) (*time.Time, error) {
+	if expires != "" && lease != "" {
+		return nil, errors.New("use either expires or lease")
+	}
+	if expires != "" {
+		t, err := time.Parse(time.RFC3339, expires)
+		if err != nil {
+			return nil, errors.New("invalid expires: " + err.Error())
+		}
+		return &t, nil
+	}
+	if lease != "" {
+		d, err := time.ParseDuration(lease)
+		if err != nil || d <= 0 {
+			return nil, errors.New("invalid lease, use a duration like 720h")
+		}
+		t := time.Now().Add(d)
+		return &t, nil
+	}
+	return nil, nil
+}
@@ -7,18 +7,26 @@ import (
 	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/config"
 	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/db"
 	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/network"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/pinqueue"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/pinsvc"
 	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/swarm"
 	"io"
 	"io/ioutil"
 	"strconv"
+	"sync"
 	"time"
 )
 
 type PinManager struct {
-	swarm *swarm.Swarm
-	db    *db.StormDB
-	net   network.NetworkInterface
-	log   *logrus.Entry
+	swarm    *swarm.Swarm
+	db       *db.StormDB
+	net      network.NetworkInterface
+	log      *logrus.Entry
+	c        *config.Config
+	queue    *pinqueue.Queue
+	remote   map[string]*pinsvc.Client
+	l        *sync.Mutex
+	lastGC   *GCReport
 }
 
 func NewPinManager(s *swarm.Swarm, db *db.StormDB, net network.NetworkInterface, l *logrus.Entry, c *config.Config) *PinManager {
@@ -27,49 +35,215 @@ func NewPinManager(s *swarm.Swarm, db *db.StormDB, net network.NetworkInterface,
 		return nil
 	}
 	pin := PinManager{
-		swarm: s,
-		db:    db,
-		net:   net,
-		log:   l.WithField("source", "pin-manager"),
+		swarm:    s,
+		db:       db,
+		net:      net,
+		log:      l.WithField("source", "pin-manager"),
+		c:        c,
+		l:        &sync.Mutex{},
+	}
+	workers := c.PinManager.Workers
+	if workers <= 0 {
+		workers = 8
+	}
+	maxQueued := c.PinManager.MaxQueued
+	if maxQueued <= 0 {
+		maxQueued = 10000
+	}
+	pin.queue = pinqueue.New(workers, maxQueued)
+	pin.remote = pin.remoteServices()
+	for i := 0; i < workers; i++ {
+		go pin.worker()
 	}
 
 	go pin.listen()
+	net.SetStreamHandler(PIN_PROTOCOL, pin.serveStream)
+	go pin.retry()
+	if len(pin.remote) > 0 {
+		go pin.replicateLoop()
+	}
+	if c.PinManager.GC.Enabled {
+		go pin.gcLoop()
+	}
+	if c.PinManager.Reconcile.Enabled {
+		go pin.reconcileLoop()
+	}
 	return &pin
 }
 
 func (pin *PinManager) listen() {
-	ch := pin.net.Subscribe()
-	for {
-		msg := <-ch
-		if msg.Kind == "new_object" && pin.swarm.PinFor(msg.From) {
-			pin.log.WithField("source", msg.From).WithField("cid", string(msg.Data)).Trace("pin request")
-			if pin.swarm.PinFor(msg.From) {
-				pin.log.WithField("cid", string(msg.Data)).WithField("origin", msg.From).Info("Auto-Pin")
-				go pin.Pin(string(msg.Data))
+	sub := pin.net.Events().Subscribe(network.SubscribeOptions{
+		Name:   "pin_manager",
+		Kinds:  []string{"new_object"},
+		Buffer: 256,
+		Policy: network.Block,
+	})
+	for msg := range sub.C {
+		if msg.Kind == "new_object" && pin.swarm.PinForIn(msg.Network, msg.From) {
+			req, err := swarm.ParsePinRequest(msg.Data)
+			if err != nil {
+				pin.log.WithField("origin", msg.From).Warn("invalid pin request: ", err)
+				continue
+			}
+			if !req.PinnedBy(pin.net.ID()) {
+				// we got it over a stream
+				continue
+			}
+			pin.log.WithField("source", msg.From).WithField("cid", req.Cid).Trace("pin request")
+			if pin.swarm.PinForIn(msg.Network, msg.From) {
+				pin.log.WithField("cid", req.Cid).WithField("origin", msg.From).Info("Auto-Pin")
+				pin.EnqueueRequest(req, msg.From, pinqueue.Trusted)
 			}
 		}
 	}
 }
 
-func (pin *PinManager) Pin(cid string) {
-	start := time.Now()
-	existing, err := pin.db.GetPin(cid)
-	if existing != nil || err == nil {
-		pin.log.WithField("cid", cid).Info("already pinned content")
-		pin.broadcastPin(cid)
+// Pin queues cid with the highest priority, expires nil pins permanently
+func (pin *PinManager) Pin(cid string, expires *time.Time) {
+	pin.EnqueueRequest(&swarm.PinRequest{Cid: cid, Expires: expires}, "admin", pinqueue.Admin)
+}
+
+// Enqueue pins cid permanently, returns false if the cid is invalid or the queue is full
+func (pin *PinManager) Enqueue(cid string, from string, priority pinqueue.Priority) bool {
+	return pin.EnqueueRequest(&swarm.PinRequest{Cid: cid}, from, priority)
+}
+
+// EnqueueRequest also renews the lease if the content is pinned already
+func (pin *PinManager) EnqueueRequest(req *swarm.PinRequest, from string, priority pinqueue.Priority) bool {
+	return pin.enqueue(req, from, priority, false)
+}
+
+// enqueue with direct set acks on the stream of the request only
+func (pin *PinManager) enqueue(req *swarm.PinRequest, from string, priority pinqueue.Priority, direct bool) bool {
+	pin.importInline(req, from)
+	return pin.push(&pinqueue.Job{
+		Cid:      req.Cid,
+		From:     from,
+		Expires:  req.Expires,
+		Priority: priority,
+		Request:  true,
+		Direct:   direct,
+	})
+}
+
+// requeue retries or resumes a pin, its lease stays as it is
+func (pin *PinManager) requeue(p *common.Pin) bool {
+	return pin.push(&pinqueue.Job{
+		Cid:      p.Ref(),
+		From:     p.From,
+		Priority: pinqueue.Transitive,
+	})
+}
+
+func (pin *PinManager) push(j *pinqueue.Job) bool {
+	cid, from := j.Cid, j.From
+	key, err := common.CidKey(cid)
+	if err != nil {
+		pin.log.WithField("cid", cid).Warn("refusing to pin invalid cid: ", err)
+		return false
+	}
+	j.Key = key
+	ok := pin.queue.Push(j)
+	if !ok {
+		pin.log.WithField("cid", cid).WithField("origin", from).Warn("pin queue is full, dropping request")
+	}
+	return ok
+}
+
+func (pin *PinManager) worker() {
+	for {
+		j := pin.queue.Pop()
+		pin.process(j)
+		pin.queue.Done(j)
+	}
+}
+
+func (pin *PinManager) process(j *pinqueue.Job) {
+	cid, key := j.Cid, j.Key
+	existing, err := pin.db.GetPin(key)
+	if err == nil {
+		if existing.Status == "blocked" {
+			pin.log.WithField("cid", cid).Info("refusing to pin blocked content")
+			return
+		}
+		if existing.Original == "" {
+			existing.Original = common.Original(cid, key)
+		}
+		if j.Request {
+			if existing.Status == "expired" || existing.Status == "removed" {
+				existing.Expires = leaseTime(j.Expires)
+			} else {
+				existing.Expires = leaseTime(common.LaterLease(leasePtr(existing.Expires), j.Expires))
+			}
+		}
+		switch existing.Status {
+		case "pinned":
+			pin.log.WithField("cid", cid).Info("already pinned content")
+			pin.db.SavePin(existing)
+			if !j.Direct {
+				pin.broadcastPin(existing.Ref(), j.From)
+			}
+			pin.replicate(existing)
+			return
+		case "failed", "expired", "rejected", "removed":
+			if !j.Request {
+				return
+			}
+			// asked again, give it a fresh set of attempts
+			existing.Attempts = 0
+			if existing.Status != "failed" {
+				// a new claim, it counts towards the quota of who asked
+				existing.From = j.From
+				if reason, over := pin.overQuota(j.From); over {
+					pin.reject(existing, reason, !j.Direct)
+					return
+				}
+			}
+		}
+		pin.attempt(existing, !j.Direct)
 		return
 	}
 	p := &common.Pin{
-		Cid:     cid,
-		Created: time.Now(),
-		Status:  "pinning",
+		Cid:      key,
+		Original: common.Original(cid, key),
+		Created:  time.Now(),
+		Status:   "pinning",
+		From:     j.From,
+		Expires:  leaseTime(j.Expires),
+	}
+	if reason, over := pin.overQuota(j.From); over {
+		pin.reject(p, reason, !j.Direct)
+		return
 	}
 	pin.db.SavePin(p)
-	err = pin.net.LocalPin(cid)
+	pin.attempt(p, !j.Direct)
+}
+
+// attempt runs one pin attempt, failures are scheduled for a retry. broadcast acks via pubsub
+func (pin *PinManager) attempt(p *common.Pin, broadcast bool) {
+	start := time.Now()
+	cid := p.Ref()
+	p.Status = "pinning"
+	pin.db.SavePin(p)
+	// keep a history of attempts for the admin api
+	defer func() {
+		record := &common.PinAttempt{
+			Cid:      p.Cid,
+			Started:  start,
+			Finished: time.Now(),
+			Status:   p.Status,
+			Size:     p.Size,
+		}
+		if p.Status != "pinned" {
+			record.Error = p.LastError
+		}
+		pin.db.SavePinAttempt(record)
+	}()
+
+	err := pin.net.LocalPin(cid)
 	if err != nil {
 		pin.log.WithField("cid", cid).Error(err)
-		p.Status = "Error"
-		pin.db.SavePin(p)
+		pin.failed(p, "Error", err)
 		return
 	}
 	// make sure we have item stored
@@ -84,49 +258,88 @@ func (pin *PinManager) Pin(cid string) {
 			// just make sure we have entire file
 			count, _ := io.Copy(ioutil.Discard, f)
 			pin.log.WithField("cid", cid).WithField("size", count).WithField("duration", time.Since(start)).Info("Store completed")
+			p.Size = count
+			if reason, over := pin.exceedsQuota(p); over {
+				pin.net.RemovePin(cid)
+				pin.reject(p, reason, broadcast)
+				return
+			}
 			p.Status = "pinned"
+			p.LastError = ""
 			pin.db.SavePin(p)
-			pin.broadcastPin(cid)
-			break
+			if broadcast {
+				pin.broadcastPin(cid, p.From)
+			}
+			pin.replicate(p)
+			return
 		} else {
-			pin.log.WithField("cid", cid).Warn(err)
+			err = e
+			pin.log.WithField("cid", cid).Warn(e)
 		}
 		time.Sleep(3 * time.Second)
 		tries++
 	}
-	if tries == 20 {
-		p.Status = "timout"
-		pin.db.SavePin(p)
-		pin.log.WithField("cid", cid).Warn("Could not complete pin, will try again later")
-	}
+	pin.failed(p, "timout", err)
 }
 
+// Renew sets a new lease on a pin, nil makes it permanent
+func (pin *PinManager) Renew(cid string, expires *time.Time) error {
+	key, err := common.CidKey(cid)
+	if err != nil {
+		return err
+	}
+	p, err := pin.db.GetPin(key)
+	if err != nil {
+		return err
+	}
+	p.Expires = leaseTime(expires)
+	return pin.db.SavePin(p)
+}
 
+// UnPin marks the pin removed, a new request pins it again. Blocked content stays blocked
 func (pin *PinManager) UnPin(cid string) error {
-	p,err := pin.db.GetPin(cid)
+	key, err := common.CidKey(cid)
+	if err != nil {
+		return err
+	}
+	p,err := pin.db.GetPin(key)
 	if err != nil {
 		pin.log.Error(err)
 		return err
 	}
+	if p.Status != "blocked" {
+		p.Status = "removed"
+	}
 	pin.db.SavePin(p)
-	return pin.net.RemovePin(cid)
+	pin.unreplicate(key)
+	return pin.net.RemovePin(p.Ref())
 }
 
 func (pin *PinManager) Block(cid string) error {
-	p,err := pin.db.GetPin(cid)
+	key, err := common.CidKey(cid)
 	if err != nil {
-		pin.log.Error(err)
 		return err
 	}
+	p,err := pin.db.GetPin(key)
+	if err != nil {
+		// block content we never pinned as well
+		p = &common.Pin{
+			Cid:      key,
+			Original: common.Original(cid, key),
+			Created:  time.Now(),
+		}
+	}
 	p.Status = "blocked"
 	pin.db.SavePin(p)
+	pin.unreplicate(key)
 	return pin.net.RemovePin(cid)
 }
 
-func (pin *PinManager) broadcastPin(cid string) {
+// broadcastPin acks the pin to from, in the federations of from
+func (pin *PinManager) broadcastPin(cid string, from string) {
 	msg := network.PubSubMessage{
 		Kind: "pinned",
 		Data: []byte(cid),
 	}
-	pin.net.SendMessage(&msg)
+	sendTo(pin.net, pin.swarm.FederationsOf(from), &msg)
 }
@@ -0,0 +1,138 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/common"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/network"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/pinqueue"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/swarm"
+	"io"
+	"time"
+)
+
+/*
+ * Targeted pin requests: the uploader opens a stream to each storage peer,
+ * writes one PinRequest and reads PinAcks until a final one. The storage
+ * peer answers "queued" right away and the outcome once the pin is done,
+ * acks of direct requests are not broadcast. Pubsub stays for caches,
+ * re-announcements and storage peers the stream does not reach, e.g.
+ * behind an external ipfs node: the announcement lists them in Fallback.
+ */
+
+const PIN_PROTOCOL = "/tezos-ipfs/pin/1.0.0"
+
+const (
+	maxPinRequestSize       = 1 << 20
+	pinStreamTimeout        = time.Hour
+	pinStreamConnectTimeout = 3 * time.Second // until the uploader falls back to pubsub
+)
+
+// requestPin sends req to peer in its federation network and calls ack for every answer
+func requestPin(ctx context.Context, net network.NetworkInterface, peer string, network string, req *swarm.PinRequest, ack func(*swarm.PinAck)) error {
+	direct := *req
+	direct.Network = network
+	req = &direct
+	s, err := net.OpenStream(ctx, peer, PIN_PROTOCOL)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	go func() {
+		// unblocks the decoder once we give up
+		<-ctx.Done()
+		s.Close()
+	}()
+	if err := json.NewEncoder(s).Encode(req); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(s)
+	for {
+		a := swarm.PinAck{}
+		if err := dec.Decode(&a); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		ack(&a)
+		if a.Final() {
+			return nil
+		}
+	}
+}
+
+// serveStream handles pin requests of peers in PinFor of the federation they name
+func (pin *PinManager) serveStream(from string, s io.ReadWriteCloser) {
+	defer s.Close()
+	enc := json.NewEncoder(s)
+	dec := json.NewDecoder(io.LimitReader(s, maxPinRequestSize))
+	req := swarm.PinRequest{}
+	if err := dec.Decode(&req); err != nil {
+		pin.log.WithField("origin", from).Warn("invalid pin request: ", err)
+		return
+	}
+	ack := &swarm.PinAck{Cid: req.Cid, Status: "rejected"}
+	if !pin.swarm.PinForIn(req.Network, from) {
+		ack.Error = "not pinning for this peer"
+		enc.Encode(ack)
+		return
+	}
+	key, err := common.CidKey(req.Cid)
+	if err != nil {
+		ack.Error = "invalid cid: " + err.Error()
+		enc.Encode(ack)
+		return
+	}
+	pin.log.WithField("cid", req.Cid).WithField("origin", from).Info("Auto-Pin, direct request")
+	if !pin.enqueue(&req, from, pinqueue.Trusted, true) {
+		ack.Error = "pin queue is full"
+		enc.Encode(ack)
+		return
+	}
+	ack.Status = "queued"
+	if err := enc.Encode(ack); err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pinStreamTimeout)
+	defer cancel()
+	go func() {
+		// the requester closes the stream once it stops waiting
+		dec.Decode(&struct{}{})
+		cancel()
+	}()
+	for pin.queue.State(key) != "" {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+	enc.Encode(pin.ackOf(key, req.Cid))
+}
+
+// ackOf reports the outcome of the last attempt to pin key
+func (pin *PinManager) ackOf(key string, cid string) *swarm.PinAck {
+	ack := &swarm.PinAck{Cid: cid}
+	p, err := pin.db.GetPin(key)
+	if err != nil {
+		ack.Status = "failed"
+		ack.Error = "unknown pin"
+		return ack
+	}
+	switch p.Status {
+	case "pinned":
+		ack.Status = "pinned"
+	case "rejected":
+		ack.Status = "rejected"
+		ack.Error = p.LastError
+	case "blocked":
+		ack.Status = "rejected"
+		ack.Error = "content is blocked"
+	default:
+		ack.Status = "failed"
+		ack.Error = p.LastError
+	}
+	return ack
+}
@@ -0,0 +1,24 @@
+package app
+
+import (
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/pinqueue"
+)
+
+type PinQueueStatus struct {
+	Stats   pinqueue.Stats
+	Running []pinqueue.Job
+	Queued  []pinqueue.Job // at most limit entries
+}
+
+// QueueStatus shows what is running and what is waiting
+func (pin *PinManager) QueueStatus(limit int) PinQueueStatus {
+	running, queued := pin.queue.Snapshot()
+	if limit > 0 && len(queued) > limit {
+		queued = queued[:limit]
+	}
+	return PinQueueStatus{
+		Stats:   pin.queue.Stats(),
+		Running: running,
+		Queued:  queued,
+	}
+}
@@ -0,0 +1,136 @@
+package app
+
+import (
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/common"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/config"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/swarm"
+	"strconv"
+)
+
+/*
+ * Quotas limit what we pin for peers in PinFor, usage is the sum of
+ * pins recorded with that peer as origin. Requests from the admin api
+ * or the pinning service are not limited.
+ */
+
+type QuotaUsage struct {
+	Origin     string
+	Bytes      int64
+	Objects    int
+	MaxBytes   int64
+	MaxObjects int
+	Over       bool
+}
+
+// quota returns the limits of origin, false if it is not limited
+func (pin *PinManager) quota(origin string) (config.Quota, bool) {
+	feds := pin.c.Federations()
+	for _, f := range feds {
+		for _, q := range f.Peers.Quotas {
+			if q.Peer == origin {
+				return q, true
+			}
+		}
+	}
+	// the default of the first federation we pin for origin in
+	for _, f := range feds {
+		if pin.swarm.PinForIn(f.Name, origin) {
+			q := f.Peers.DefaultQuota
+			q.Peer = origin
+			return q, q.MaxBytes > 0 || q.MaxObjects > 0
+		}
+	}
+	return config.Quota{}, false
+}
+
+func (pin *PinManager) usage(q config.Quota) QuotaUsage {
+	u := QuotaUsage{
+		Origin:     q.Peer,
+		MaxBytes:   q.MaxBytes,
+		MaxObjects: q.MaxObjects,
+	}
+	var err error
+	u.Bytes, u.Objects, err = pin.db.OriginUsage(q.Peer)
+	if err != nil {
+		pin.log.WithField("origin", q.Peer).Error("Failed to compute usage: ", err)
+	}
+	u.Over = (q.MaxBytes > 0 && u.Bytes >= q.MaxBytes) || (q.MaxObjects > 0 && u.Objects >= q.MaxObjects)
+	return u
+}
+
+// overQuota returns a reason if origin may not pin anything else
+func (pin *PinManager) overQuota(origin string) (string, bool) {
+	q, ok := pin.quota(origin)
+	if !ok {
+		return "", false
+	}
+	u := pin.usage(q)
+	if q.MaxObjects > 0 && u.Objects >= q.MaxObjects {
+		return "object quota of " + strconv.Itoa(q.MaxObjects) + " reached", true
+	}
+	if q.MaxBytes > 0 && u.Bytes >= q.MaxBytes {
+		return "quota of " + strconv.FormatInt(q.MaxBytes, 10) + " bytes reached", true
+	}
+	return "", false
+}
+
+/*
+ * exceedsQuota checks the byte quota again once the size of p is known,
+ * the request was only checked against what the origin used before
+ */
+func (pin *PinManager) exceedsQuota(p *common.Pin) (string, bool) {
+	q, ok := pin.quota(p.From)
+	if !ok || q.MaxBytes <= 0 {
+		return "", false
+	}
+	// p counts towards the usage while it is pinning
+	pin.db.SavePin(p)
+	if u := pin.usage(q); u.Bytes > q.MaxBytes {
+		return "quota of " + strconv.FormatInt(q.MaxBytes, 10) + " bytes exceeded by " + strconv.FormatInt(p.Size, 10) + " bytes of content", true
+	}
+	return "", false
+}
+
+// Quotas shows the usage of every limited origin
+func (pin *PinManager) Quotas() []QuotaUsage {
+	res := []QuotaUsage{}
+	seen := map[string]bool{}
+	for _, f := range pin.c.Federations() {
+		for _, q := range f.Peers.Quotas {
+			if seen[q.Peer] {
+				continue
+			}
+			seen[q.Peer] = true
+			res = append(res, pin.usage(q))
+		}
+	}
+	for _, f := range pin.c.Federations() {
+		for _, peer := range f.Peers.PinFor {
+			if seen[peer] {
+				continue
+			}
+			seen[peer] = true
+			if q, ok := pin.quota(peer); ok {
+				res = append(res, pin.usage(q))
+			}
+		}
+	}
+	return res
+}
+
+// reject records the refusal and tells the origin about it, unless it asked over a stream
+func (pin *PinManager) reject(p *common.Pin, reason string, broadcast bool) {
+	p.Status = "rejected"
+	p.LastError = reason
+	pin.db.SavePin(p)
+	pin.log.WithField("cid", p.Cid).WithField("origin", p.From).Warn("Refusing to pin: ", reason)
+	if !broadcast {
+		return
+	}
+	msg := swarm.PinRejection{
+		Cid:    p.Ref(),
+		Origin: p.From,
+		Reason: reason,
+	}
+	sendTo(pin.net, pin.swarm.FederationsOf(p.From), msg.ToTransportFormat())
+}
@@ -0,0 +1,160 @@
+package app
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/common"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/db"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/network"
+	"time"
+)
+
+type PinReconcileReport struct {
+	NodePins int // recursive pins on the node
+	Records  int // pins in the db
+	Imported int // pinned on the node, unknown to the db
+	Missing  int // pinned in the db, not on the node
+	Requeued int // missing pins queued to be pinned again
+	Removed  int // blocked, expired or removed, but still pinned on the node
+	Errors   int
+	DryRun   bool
+	Duration time.Duration
+}
+
+/*
+ * PinReconciler runs the reconciliation without a running PinManager,
+ * e.g. from the cli. Missing pins are then marked "pinning" and
+ * the next daemon resumes them.
+ */
+type PinReconciler struct {
+	db      *db.StormDB
+	net     network.NetworkInterface
+	log     *logrus.Entry
+	manager *PinManager // queues missing pins, nil from the cli
+}
+
+func NewPinReconciler(db *db.StormDB, net network.NetworkInterface, l *logrus.Entry) *PinReconciler {
+	return &PinReconciler{
+		db:  db,
+		net: net,
+		log: l.WithField("source", "pin-reconcile"),
+	}
+}
+
+func (pin *PinManager) reconcileLoop() {
+	// give the node a moment before the first run
+	time.Sleep(time.Minute)
+	for {
+		pin.Reconcile(false)
+		interval := time.Duration(pin.c.PinManager.Reconcile.Interval) * time.Hour
+		if interval <= 0 {
+			interval = 24 * time.Hour
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Reconcile runs the reconciliation, missing pins go to the queue
+func (pin *PinManager) Reconcile(dryRun bool) *PinReconcileReport {
+	r := &PinReconciler{db: pin.db, net: pin.net, log: pin.log, manager: pin}
+	return r.Reconcile(dryRun)
+}
+
+/*
+ * Reconcile compares the pin records with the pinset of the node:
+ * unknown recursive pins are imported, records missing on the node
+ * are pinned again and blocked, expired or removed content is unpinned.
+ * In dryRun mode it only reports.
+ */
+func (r *PinReconciler) Reconcile(dryRun bool) *PinReconcileReport {
+	start := time.Now()
+	report := &PinReconcileReport{DryRun: dryRun}
+	r.log.Info("Starting pin reconciliation")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	pins, err := r.net.ListPins(ctx)
+	cancel()
+	if err != nil {
+		r.log.Error("Failed to list pins of the node: ", err)
+		report.Errors++
+		return report
+	}
+	onNode := map[string]string{}
+	for _, cid := range pins {
+		key, err := common.CidKey(cid)
+		if err != nil {
+			report.Errors++
+			continue
+		}
+		onNode[key] = cid
+	}
+	report.NodePins = len(onNode)
+
+	records, err := r.db.PinsByStatus("pinned", "blocked", "expired", "removed")
+	if err != nil {
+		r.log.Error("Failed to load pins: ", err)
+		report.Errors++
+		return report
+	}
+	report.Records = len(records)
+	known := map[string]bool{}
+	for i := range records {
+		p := &records[i]
+		known[p.Cid] = true
+		cid, pinned := onNode[p.Cid]
+		switch {
+		case p.Status == "pinned" && !pinned:
+			report.Missing++
+			if dryRun || (r.manager != nil && r.manager.queue.State(p.Cid) != "") {
+				continue
+			}
+			r.log.WithField("cid", p.Cid).Warn("Pin missing on the node, pinning again")
+			// "pinned" would make the queue skip it, "pinning" is also resumed on startup
+			p.Status = "pinning"
+			r.db.SavePin(p)
+			if r.manager == nil || r.manager.requeue(p) {
+				report.Requeued++
+			}
+		case p.Status != "pinned" && pinned:
+			report.Removed++
+			if dryRun {
+				continue
+			}
+			r.log.WithField("cid", p.Cid).WithField("status", p.Status).Info("Removing pin from the node")
+			if err := r.net.RemovePin(cid); err != nil {
+				r.log.WithField("cid", p.Cid).Warn("Could not unpin: ", err)
+				report.Errors++
+			}
+		}
+	}
+
+	for key, cid := range onNode {
+		if known[key] {
+			continue
+		}
+		if _, err := r.db.GetPin(key); err == nil {
+			// pinning, failed or rejected, the queue takes care of it
+			continue
+		}
+		report.Imported++
+		if dryRun {
+			continue
+		}
+		r.log.WithField("cid", cid).Info("Importing pin of the node")
+		r.db.SavePin(&common.Pin{
+			Cid:      key,
+			Original: common.Original(cid, key),
+			Created:  time.Now(),
+			Status:   "pinned",
+			From:     "node",
+		})
+	}
+
+	report.Duration = time.Since(start)
+	r.log.WithField("imported", report.Imported).
+		WithField("missing", report.Missing).
+		WithField("removed", report.Removed).
+		WithField("errors", report.Errors).
+		WithField("duration", report.Duration).Info("Pin reconciliation completed")
+	return report
+}
@@ -0,0 +1,98 @@
+package app
+
+import (
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/common"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/pinsvc"
+	"time"
+)
+
+/*
+ * Pinned content is replicated to the configured remote pinning services.
+ * Every cid gets one RemotePin per service: "new" until the request is
+ * accepted, "queued" or "pinning" while we poll the service, then "pinned".
+ * Failures go back to "new" with exponential backoff, after MaxAttempts
+ * the record ends up as "failed".
+ */
+
+func (pin *PinManager) remoteServices() map[string]*pinsvc.Client {
+	clients := map[string]*pinsvc.Client{}
+	for _, s := range pin.c.PinManager.RemoteServices {
+		if s.Name == "" || s.Endpoint == "" {
+			pin.log.Warn("Ignoring remote pinning service without name or endpoint")
+			continue
+		}
+		clients[s.Name] = pinsvc.NewClient(s.Endpoint, s.Token)
+	}
+	return clients
+}
+
+// replicate creates the remote records for a pin
+func (pin *PinManager) replicate(p *common.Pin) {
+	if len(pin.remote) == 0 {
+		return
+	}
+	existing, _ := pin.db.GetRemotePins(p.Cid)
+	known := map[string]bool{}
+	for _, r := range existing {
+		known[r.Service] = true
+	}
+	for name := range pin.remote {
+		if known[name] {
+			continue
+		}
+		pin.db.SaveRemotePin(&common.RemotePin{
+			Cid:         p.Cid,
+			Original:    p.Original,
+			Service:     name,
+			Status:      "new",
+			NextAttempt: time.Now(),
+			Updated:     time.Now(),
+		})
+	}
+}
+
+// unreplicate removes our requests from all remote services
+func (pin *PinManager) unreplicate(key string) {
+	remote, _ := pin.db.GetRemotePins(key)
+	for i := range remote {
+		r := &remote[i]
+		if client, ok := pin.remote[r.Service]; ok && r.RequestID != "" {
+			if err := client.Delete(r.RequestID); err != nil && err != pinsvc.ErrNotFound {
+				pin.log.WithField("cid", key).WithField("service", r.Service).Warn("Could not remove remote pin: ", err)
+			}
+		}
+		pin.db.RemoveRemotePin(r)
+	}
+}
+
+func (pin *PinManager) replicateLoop() {
+	for {
+		due, err := pin.db.DueRemotePins(time.Now(), "new", "queued", "pinning")
+		if err != nil {
+			pin.log.Error("Failed to load due remote pins: ", err)
+		}
+		for i := range due {
+			r := &due[i]
+			client, ok := pin.remote[r.Service]
+			if !ok {
+				// service was removed from the config
+				continue
+			}
+			pin.syncRemote(client, r)
+		}
+		time.Sleep(30 * time.Second)
+	}
+}
+
+func (pin *PinManager) syncRemote(client *pinsvc.Client, r *common.RemotePin) {
+	err := pinsvc.Sync(client, r, pin.net.Addrs(), pin.maxAttempts(), pin.backoff)
+	switch {
+	case err != nil && r.Status == "failed":
+		pin.log.WithField("cid", r.Cid).WithField("service", r.Service).Error("Giving up on remote pin: ", err)
+	case err != nil:
+		pin.log.WithField("cid", r.Cid).WithField("service", r.Service).Warn("Remote pin failed, will try again later: ", err)
+	case r.Status == pinsvc.StatusPinned:
+		pin.log.WithField("cid", r.Cid).WithField("service", r.Service).Info("Replicated to remote service")
+	}
+	pin.db.SaveRemotePin(r)
+}
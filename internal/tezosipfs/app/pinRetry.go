@@ -0,0 +1,86 @@
+package app
+
+import (
+	"errors"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/common"
+	"time"
+)
+
+/*
+ * The pin table doubles as a durable queue: pins that failed ("Error")
+ * or timed out ("timout") get a NextAttempt with exponential backoff,
+ * after MaxAttempts they end up as "failed" and are not retried anymore.
+ */
+
+// retry resumes interrupted pins and then polls for due retries
+func (pin *PinManager) retry() {
+	// nothing is in flight yet, "pinning" was interrupted by a restart,
+	// failed attempts keep their backoff and are picked up once due
+	resume, err := pin.db.PinsByStatus("pinning")
+	if err != nil {
+		pin.log.Error("Failed to load pins to resume: ", err)
+	}
+	if len(resume) > 0 {
+		pin.log.WithField("count", len(resume)).Info("Resuming unfinished pins")
+	}
+	for i := range resume {
+		pin.requeue(&resume[i])
+	}
+
+	for {
+		time.Sleep(30 * time.Second)
+		due, err := pin.db.DuePins(time.Now(), "timout", "Error")
+		if err != nil {
+			pin.log.Error("Failed to load due pins: ", err)
+			continue
+		}
+		for i := range due {
+			pin.log.WithField("cid", due[i].Cid).WithField("attempt", due[i].Attempts+1).Trace("Retrying pin")
+			pin.requeue(&due[i])
+		}
+	}
+}
+
+func (pin *PinManager) failed(p *common.Pin, status string, err error) {
+	if err == nil {
+		err = errors.New(status)
+	}
+	p.Attempts++
+	p.LastError = err.Error()
+	if p.Attempts >= pin.maxAttempts() {
+		p.Status = "failed"
+		pin.log.WithField("cid", p.Cid).WithField("attempts", p.Attempts).Error("Giving up on pin")
+	} else {
+		p.Status = status
+		p.NextAttempt = time.Now().Add(pin.backoff(p.Attempts))
+		pin.log.WithField("cid", p.Cid).WithField("next_attempt", p.NextAttempt).Warn("Could not complete pin, will try again later")
+	}
+	pin.db.SavePin(p)
+}
+
+func (pin *PinManager) maxAttempts() int {
+	if pin.c.PinManager.Retry.MaxAttempts > 0 {
+		return pin.c.PinManager.Retry.MaxAttempts
+	}
+	return 10
+}
+
+// backoff doubles after every attempt, starting at Retry.Backoff
+func (pin *PinManager) backoff(attempts int) time.Duration {
+	base := time.Duration(pin.c.PinManager.Retry.Backoff) * time.Second
+	if base <= 0 {
+		base = time.Minute
+	}
+	max := time.Duration(pin.c.PinManager.Retry.MaxBackoff) * time.Second
+	if max <= 0 {
+		max = 6 * time.Hour
+	}
+	d := base
+	for i := 1; i < attempts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
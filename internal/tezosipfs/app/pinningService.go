@@ -0,0 +1,350 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/common"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/config"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/db"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/network"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/pinqueue"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/pinsvc"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// origin of pins requested through the pinning service api
+const PINNING_SERVICE_ORIGIN = "pinning-service/"
+
+var errInvalidLimit = errors.New("invalid limit, must be between 1 and 1000")
+
+/*
+ * PinningService implements the IPFS Pinning Service API
+ * on top of the PinManager, so any compliant client
+ * (e.g. `ipfs pin remote`) can use our storage
+ */
+type PinningService struct {
+	pin *PinManager
+	db  *db.StormDB
+	net network.NetworkInterface
+	log *logrus.Entry
+	c   *config.Config
+}
+
+func NewPinningService(c *config.Config, pin *PinManager, db *db.StormDB, net network.NetworkInterface, l *logrus.Entry) *PinningService {
+	if !c.PinningService.Enabled {
+		return nil
+	}
+	if pin == nil {
+		l.Warn("Pinning service needs the PinManager, not starting it")
+		return nil
+	}
+	s := PinningService{
+		pin: pin,
+		db:  db,
+		net: net,
+		log: l.WithField("source", "pinning-service"),
+		c:   c,
+	}
+	return &s
+}
+
+func (s *PinningService) Run() {
+	addr := s.c.PinningService.Host + ":" + strconv.Itoa(s.c.PinningService.Port)
+	s.log.Info("Starting pinning service api on: " + addr)
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	r.Use(s.auth)
+	r.GET("/pins", s.listRoute)
+	r.POST("/pins", s.addRoute)
+	r.GET("/pins/:requestid", s.getRoute)
+	r.POST("/pins/:requestid", s.replaceRoute)
+	r.DELETE("/pins/:requestid", s.deleteRoute)
+	r.Run(addr)
+}
+
+// auth checks the bearer token and remembers its name as owner
+func (s *PinningService) auth(c *gin.Context) {
+	header := c.GetHeader("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		c.AbortWithStatusJSON(401, pinsvc.NewFailure("UNAUTHORIZED", "missing bearer token"))
+		return
+	}
+	token := strings.TrimPrefix(header, "Bearer ")
+	for _, t := range s.c.PinningService.AccessTokens {
+		if t.Token != "" && t.Token == token {
+			c.Set("owner", t.Name)
+			c.Next()
+			return
+		}
+	}
+	c.AbortWithStatusJSON(401, pinsvc.NewFailure("UNAUTHORIZED", "invalid bearer token"))
+}
+
+func (s *PinningService) listRoute(c *gin.Context) {
+	owner := c.GetString("owner")
+	f, err := parseServiceFilter(c)
+	if err != nil {
+		c.JSON(400, pinsvc.NewFailure("BAD_REQUEST", err.Error()))
+		return
+	}
+	pins, err := s.db.ServicePins(owner)
+	if err != nil {
+		c.JSON(500, pinsvc.NewFailure("INTERNAL_SERVER_ERROR", err.Error()))
+		return
+	}
+	res := pinsvc.PinResults{Results: []pinsvc.PinStatus{}}
+	delegates := s.net.Addrs()
+	for i := range pins {
+		status := s.status(&pins[i], delegates)
+		if !f.matches(&pins[i], status.Status) {
+			continue
+		}
+		res.Count++
+		if len(res.Results) < f.limit {
+			res.Results = append(res.Results, status)
+		}
+	}
+	c.JSON(200, res)
+}
+
+func (s *PinningService) addRoute(c *gin.Context) {
+	p := pinsvc.Pin{}
+	if err := c.BindJSON(&p); err != nil {
+		c.JSON(400, pinsvc.NewFailure("BAD_REQUEST", err.Error()))
+		return
+	}
+	sp, err := s.add(c.GetString("owner"), p)
+	if err != nil {
+		c.JSON(400, pinsvc.NewFailure("BAD_REQUEST", err.Error()))
+		return
+	}
+	c.JSON(202, s.status(sp, s.net.Addrs()))
+}
+
+func (s *PinningService) getRoute(c *gin.Context) {
+	sp, ok := s.lookup(c)
+	if !ok {
+		return
+	}
+	c.JSON(200, s.status(sp, s.net.Addrs()))
+}
+
+func (s *PinningService) replaceRoute(c *gin.Context) {
+	old, ok := s.lookup(c)
+	if !ok {
+		return
+	}
+	p := pinsvc.Pin{}
+	if err := c.BindJSON(&p); err != nil {
+		c.JSON(400, pinsvc.NewFailure("BAD_REQUEST", err.Error()))
+		return
+	}
+	sp, err := s.add(old.Owner, p)
+	if err != nil {
+		c.JSON(400, pinsvc.NewFailure("BAD_REQUEST", err.Error()))
+		return
+	}
+	if sp.Cid != old.Cid {
+		s.remove(old)
+	} else {
+		s.db.RemoveServicePin(old)
+	}
+	c.JSON(202, s.status(sp, s.net.Addrs()))
+}
+
+func (s *PinningService) deleteRoute(c *gin.Context) {
+	sp, ok := s.lookup(c)
+	if !ok {
+		return
+	}
+	s.remove(sp)
+	c.Status(202)
+}
+
+// lookup finds the request, only its owner may see it
+func (s *PinningService) lookup(c *gin.Context) (*common.ServicePin, bool) {
+	sp, err := s.db.GetServicePin(c.Param("requestid"))
+	if err != nil || sp.Owner != c.GetString("owner") {
+		c.JSON(404, pinsvc.NewFailure("NOT_FOUND", "the specified resource was not found"))
+		return nil, false
+	}
+	return sp, true
+}
+
+func (s *PinningService) add(owner string, p pinsvc.Pin) (*common.ServicePin, error) {
+	key, err := common.CidKey(p.Cid)
+	if err != nil {
+		return nil, err
+	}
+	sp := &common.ServicePin{
+		RequestID: uuid.New().String(),
+		Cid:       key,
+		Original:  p.Cid,
+		Name:      p.Name,
+		Origins:   p.Origins,
+		Meta:      p.Meta,
+		Owner:     owner,
+		Created:   time.Now(),
+	}
+	if err := s.db.SaveServicePin(sp); err != nil {
+		return nil, err
+	}
+	go func() {
+		// origins are a hint, connect first so bitswap finds the content quickly
+		if len(p.Origins) > 0 {
+			s.net.ConnectAddrs(p.Origins)
+		}
+		s.pin.Enqueue(p.Cid, PINNING_SERVICE_ORIGIN+owner, pinqueue.Trusted)
+	}()
+	return sp, nil
+}
+
+// remove deletes the request and unpins content nobody else asked us to keep
+func (s *PinningService) remove(sp *common.ServicePin) {
+	s.db.RemoveServicePin(sp)
+	if n, err := s.db.CountServicePins(sp.Cid); err != nil || n > 0 {
+		return
+	}
+	p, err := s.db.GetPin(sp.Cid)
+	if err != nil || !strings.HasPrefix(p.From, PINNING_SERVICE_ORIGIN) {
+		return
+	}
+	if err := s.pin.UnPin(sp.Original); err != nil {
+		s.log.WithField("cid", sp.Original).Warn("Could not unpin: ", err)
+	}
+}
+
+func (s *PinningService) status(sp *common.ServicePin, delegates []string) pinsvc.PinStatus {
+	res := pinsvc.PinStatus{
+		RequestID: sp.RequestID,
+		Status:    pinsvc.StatusQueued,
+		Created:   sp.Created,
+		Pin: pinsvc.Pin{
+			Cid:     sp.Original,
+			Name:    sp.Name,
+			Origins: sp.Origins,
+			Meta:    sp.Meta,
+		},
+		Delegates: delegates,
+	}
+	switch s.pin.queue.State(sp.Cid) {
+	case "running":
+		res.Status = pinsvc.StatusPinning
+		return res
+	case "queued":
+		return res
+	}
+	p, err := s.db.GetPin(sp.Cid)
+	if err != nil {
+		return res
+	}
+	switch p.Status {
+	case "pinned":
+		res.Status = pinsvc.StatusPinned
+	case "pinning":
+		res.Status = pinsvc.StatusPinning
+	case "failed", "blocked":
+		res.Status = pinsvc.StatusFailed
+	default:
+		// waiting for a retry
+		res.Status = pinsvc.StatusQueued
+	}
+	if p.LastError != "" && res.Status != pinsvc.StatusPinned {
+		res.Info = map[string]string{"status_details": p.LastError}
+	}
+	return res
+}
+
+type serviceFilter struct {
+	cids   map[string]bool
+	name   string
+	match  string
+	status map[string]bool
+	before time.Time
+	after  time.Time
+	meta   map[string]string
+	limit  int
+}
+
+func parseServiceFilter(c *gin.Context) (*serviceFilter, error) {
+	f := &serviceFilter{
+		name:   c.Query("name"),
+		match:  c.DefaultQuery("match", "exact"),
+		status: map[string]bool{},
+		limit:  10,
+	}
+	if v := c.Query("cid"); v != "" {
+		f.cids = map[string]bool{}
+		for _, cid := range strings.Split(v, ",") {
+			key, err := common.CidKey(cid)
+			if err != nil {
+				return nil, err
+			}
+			f.cids[key] = true
+		}
+	}
+	for _, st := range strings.Split(c.DefaultQuery("status", pinsvc.StatusPinned), ",") {
+		f.status[st] = true
+	}
+	var err error
+	if v := c.Query("before"); v != "" {
+		if f.before, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, err
+		}
+	}
+	if v := c.Query("after"); v != "" {
+		if f.after, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, err
+		}
+	}
+	if v := c.Query("meta"); v != "" {
+		if err := json.Unmarshal([]byte(v), &f.meta); err != nil {
+			return nil, err
+		}
+	}
+	if v := c.Query("limit"); v != "" {
+		if f.limit, err = strconv.Atoi(v); err != nil || f.limit < 1 || f.limit > 1000 {
+			return nil, errInvalidLimit
+		}
+	}
+	return f, nil
+}
+
+func (f *serviceFilter) matches(sp *common.ServicePin, status string) bool {
+	if !f.status[status] {
+		return false
+	}
+	if f.cids != nil && !f.cids[sp.Cid] {
+		return false
+	}
+	if f.name != "" {
+		name, want := sp.Name, f.name
+		if f.match == "iexact" || f.match == "ipartial" {
+			name, want = strings.ToLower(name), strings.ToLower(want)
+		}
+		if f.match == "partial" || f.match == "ipartial" {
+			if !strings.Contains(name, want) {
+				return false
+			}
+		} else if name != want {
+			return false
+		}
+	}
+	if !f.before.IsZero() && !sp.Created.Before(f.before) {
+		return false
+	}
+	if !f.after.IsZero() && !sp.Created.After(f.after) {
+		return false
+	}
+	for k, v := range f.meta {
+		if sp.Meta[k] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,285 @@
+package app
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/common"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/config"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/db"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/network"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/swarm"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+ * Replicator records "pinned" acknowledgements and makes sure content
+ * we announced keeps its target number of copies. Only acks from peers
+ * that currently pin for us count, so when a storage peer disappears
+ * its content is announced again and picked up by the remaining peers.
+ */
+type Replicator struct {
+	swarm   *swarm.Swarm
+	db      *db.StormDB
+	net     network.NetworkInterface
+	log     *logrus.Entry
+	c       *config.Config
+	l       *sync.Mutex
+	pending map[string]*openChallenge // by nonce
+}
+
+type ReplicaStatus struct {
+	Cid           string
+	Target        int
+	Replicas      int
+	Local         bool     // pinned on this node
+	Peers         []string // live peers that acknowledged
+	Stale         []string // acknowledged, but gone or no longer pinning for us
+	Failing       []string // acknowledged, but failing storage challenges
+	Announced     time.Time
+	Announcements int
+}
+
+func NewReplicator(c *config.Config, s *swarm.Swarm, db *db.StormDB, net network.NetworkInterface, l *logrus.Entry) *Replicator {
+	r := Replicator{
+		swarm:   s,
+		db:      db,
+		net:     net,
+		log:     l.WithField("source", "replicator"),
+		c:       c,
+		l:       &sync.Mutex{},
+		pending: map[string]*openChallenge{},
+	}
+	go r.listen()
+	if c.Replication.Enabled {
+		go r.run()
+	}
+	if c.Replication.Challenges.Enabled {
+		go r.challengeLoop()
+	}
+	return &r
+}
+
+func (r *Replicator) listen() {
+	sub := r.net.Events().Subscribe(network.SubscribeOptions{
+		Name:   "replicator",
+		Kinds:  []string{"pinned", "storage_challenge", "storage_proof"},
+		Buffer: 256,
+		Policy: network.Block,
+	})
+	for msg := range sub.C {
+		switch msg.Kind {
+		case "pinned":
+			if r.swarm.PinsForUs(msg.Network, msg.From) {
+				r.recordAck(string(msg.Data), msg.From)
+			}
+		case "storage_challenge":
+			go r.respond(msg)
+		case "storage_proof":
+			r.receiveProof(msg)
+		}
+	}
+}
+
+// recordAck remembers which peers confirmed storing a cid we know about
+func (r *Replicator) recordAck(cid string, from string) {
+	key, err := common.CidKey(cid)
+	if err != nil || from == r.net.ID() {
+		return
+	}
+	if rep, err := r.db.GetReplication(key); err == nil {
+		if rep.Announcements > 0 {
+			// a new copy, announce again at the normal interval if it is still short
+			rep.Announcements = 0
+			r.db.SaveReplication(rep)
+		}
+	} else if _, err := r.db.GetPin(key); err != nil {
+		return
+	}
+	r.db.SavePinAck(&common.PinAck{
+		Cid:      key,
+		Peer:     from,
+		Received: time.Now(),
+	})
+}
+
+// Track starts enforcing target copies of cid until expires, 0 uses the configured factor
+func (r *Replicator) Track(cid string, target int, expires *time.Time) error {
+	key, err := common.CidKey(cid)
+	if err != nil {
+		return err
+	}
+	rep, err := r.db.GetReplication(key)
+	if err != nil {
+		rep = &common.Replication{
+			Cid:       key,
+			Created:   time.Now(),
+			Announced: time.Now(),
+		}
+	}
+	if rep.Original == "" {
+		rep.Original = common.Original(cid, key)
+	}
+	if target > 0 {
+		rep.Target = target
+	}
+	rep.Expires = leaseTime(expires)
+	return r.db.SaveReplication(rep)
+}
+
+// Renew changes the lease of tracked content, nil makes it permanent
+func (r *Replicator) Renew(key string, expires *time.Time) error {
+	rep, err := r.db.GetReplication(key)
+	if err != nil {
+		return err
+	}
+	rep.Expires = leaseTime(expires)
+	return r.db.SaveReplication(rep)
+}
+
+func (r *Replicator) Untrack(key string) {
+	if rep, err := r.db.GetReplication(key); err == nil {
+		r.db.RemoveReplication(rep)
+	}
+}
+
+func (r *Replicator) run() {
+	for {
+		time.Sleep(r.interval())
+		r.Reconcile()
+	}
+}
+
+func (r *Replicator) interval() time.Duration {
+	interval := time.Duration(r.c.Replication.Interval) * time.Minute
+	if interval <= 0 {
+		interval = 10 * time.Minute
+	}
+	return interval
+}
+
+// backoff is the time after the last announcement before we announce again, doubling up to a day
+func (r *Replicator) backoff(announcements int) time.Duration {
+	wait := r.interval()
+	for i := 0; i < announcements && wait < 24*time.Hour; i++ {
+		wait *= 2
+	}
+	if wait > 24*time.Hour {
+		wait = 24 * time.Hour
+	}
+	return wait
+}
+
+/*
+ * Reconcile announces every under-replicated cid again. Content nobody
+ * picks up is announced less and less often, see backoff.
+ */
+func (r *Replicator) Reconcile() int {
+	under, err := r.UnderReplicated()
+	if err != nil {
+		r.log.Error("Failed to check replication: ", err)
+		return 0
+	}
+	announced := 0
+	for _, s := range under {
+		rep, err := r.db.GetReplication(s.Cid)
+		if err != nil {
+			continue
+		}
+		if !rep.Expires.IsZero() && rep.Expires.Before(time.Now()) {
+			// lease ended, nobody needs to store it anymore
+			r.db.RemoveReplication(rep)
+			continue
+		}
+		// half an interval of slack, runs do not start exactly one interval apart
+		if time.Since(rep.Announced)+r.interval()/2 < r.backoff(rep.Announcements) {
+			continue
+		}
+		r.log.WithField("cid", s.Cid).
+			WithField("replicas", s.Replicas).
+			WithField("target", s.Target).Info("Under-replicated, announcing again")
+		req := swarm.PinRequest{
+			Cid:     rep.Ref(),
+			Expires: leasePtr(rep.Expires),
+		}
+		sendTo(r.net, r.swarm.ForUsIn(), req.ToTransportFormat())
+		rep.Announced = time.Now()
+		rep.Announcements++
+		r.db.SaveReplication(rep)
+		announced++
+	}
+	return announced
+}
+
+// UnderReplicated lists tracked cids below target, fewest copies first
+func (r *Replicator) UnderReplicated() ([]ReplicaStatus, error) {
+	all, err := r.Status()
+	if err != nil {
+		return nil, err
+	}
+	res := []ReplicaStatus{}
+	for _, s := range all {
+		if s.Replicas < s.Target {
+			res = append(res, s)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Replicas < res[j].Replicas
+	})
+	return res, nil
+}
+
+// Status returns the replica count of every tracked cid
+func (r *Replicator) Status() ([]ReplicaStatus, error) {
+	reps, err := r.db.Replications()
+	if err != nil {
+		return nil, err
+	}
+	live := map[string]bool{}
+	for _, p := range r.swarm.PinForUs() {
+		live[p.PeerId] = true
+	}
+	res := []ReplicaStatus{}
+	for i := range reps {
+		res = append(res, r.status(&reps[i], live))
+	}
+	return res, nil
+}
+
+func (r *Replicator) status(rep *common.Replication, live map[string]bool) ReplicaStatus {
+	s := ReplicaStatus{
+		Cid:           rep.Cid,
+		Target:        rep.Target,
+		Peers:         []string{},
+		Stale:         []string{},
+		Failing:       []string{},
+		Announced:     rep.Announced,
+		Announcements: rep.Announcements,
+	}
+	if s.Target <= 0 {
+		s.Target = r.factor()
+	}
+	if p, err := r.db.GetPin(rep.Cid); err == nil && p.Status == "pinned" {
+		s.Local = true
+		s.Replicas++
+	}
+	acks, _ := r.db.GetPinAcks(rep.Cid)
+	for _, a := range acks {
+		if r.Failing(a.Peer) {
+			s.Failing = append(s.Failing, a.Peer)
+		} else if live[a.Peer] {
+			s.Peers = append(s.Peers, a.Peer)
+			s.Replicas++
+		} else {
+			s.Stale = append(s.Stale, a.Peer)
+		}
+	}
+	return s
+}
+
+func (r *Replicator) factor() int {
+	if r.c.Replication.Factor > 0 {
+		return r.c.Replication.Factor
+	}
+	return 2
+}
@@ -1,9 +1,18 @@
 package cache
 
-import "io"
+import (
+	"io"
+	"time"
+)
 
 type Cache interface {
 	GetFile(cid string) (int64,io.Reader,error)
-	StoreFile(cid string, reader io.ReadSeeker)
-	Uncache(cid string)
+	StoreFile(cid string, reader io.ReadSeeker) error
+	Uncache(cid string) error
+}
+
+// Presigner is implemented by caches clients can download from directly
+type Presigner interface {
+	Stat(cid string) (size int64, contentType string, err error)
+	PresignGet(cid string, expiry time.Duration, contentType string, disposition string) (string, error)
 }
@@ -10,18 +10,25 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/config"
 	"io"
+	"strings"
+	"time"
 )
 
+// objects that failed verification are moved here
+const QUARANTINE_PREFIX = "quarantine/"
+
 type S3Cache struct {
 	log *logrus.Entry
 	config *config.S3
 	s3client *s3.S3
 	downloader *s3manager.Downloader
+	verify bool
 }
 
 func NewS3Cache(c *config.Config, l *logrus.Entry) *S3Cache {
 	s := S3Cache{}
 	s.config = &c.Gateway.Storage.S3
+	s.verify = c.Gateway.Storage.Verify
 	s.log = l.WithField("source","s3-file-cache")
 
 	s3Config := &aws.Config{
@@ -68,30 +75,139 @@ func (c *S3Cache) GetFile(cid string) (int64,io.Reader,error) {
 		return 0,nil,err
 	}
 
+	if c.verify {
+		ok, err := Verify(cid, buf.Bytes())
+		if err != nil {
+			// not a mismatch, a fresh copy would fail the same way
+			c.log.WithField("cid", cid).Warn("Could not verify cached content: ", err)
+			return len, bytes.NewReader(buf.Bytes()), ErrUnverifiable
+		}
+		if !ok {
+			c.log.WithField("cid", cid).Error("cached content does not match cid, quarantining")
+			c.Quarantine(cid)
+			return 0, nil, ErrIntegrity
+		}
+	}
+
 	return len,bytes.NewReader(buf.Bytes()),nil
 }
 
+func (c *S3Cache) Stat(cid string) (int64, string, error) {
+	res, err := c.s3client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(c.config.Bucket),
+		Key:    aws.String(cid),
+	})
+	if err != nil {
+		return 0, "", err
+	}
+	return aws.Int64Value(res.ContentLength), aws.StringValue(res.ContentType), nil
+}
+
+// PresignGet returns a short lived url for cid, type and disposition are response overrides
+func (c *S3Cache) PresignGet(cid string, expiry time.Duration, contentType string, disposition string) (string, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(c.config.Bucket),
+		Key:    aws.String(cid),
+	}
+	if contentType != "" {
+		input.ResponseContentType = aws.String(contentType)
+	}
+	if disposition != "" {
+		input.ResponseContentDisposition = aws.String(disposition)
+	}
+	req, _ := c.s3client.GetObjectRequest(input)
+	return req.Presign(expiry)
+}
+
+// GetRaw downloads an object without verifying it
+func (c *S3Cache) GetRaw(key string) ([]byte, error) {
+	buf := aws.NewWriteAtBuffer([]byte{})
+	_, err := c.downloader.Download(buf,
+		&s3.GetObjectInput{
+			Bucket: aws.String(c.config.Bucket),
+			Key:    aws.String(key),
+		})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
 
-func (c *S3Cache) StoreFile(cid string, reader io.ReadSeeker) {
+// List calls fn for every cached object, quarantined objects are skipped
+func (c *S3Cache) List(fn func(cid string, size int64, modified time.Time)) error {
+	return c.s3client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(c.config.Bucket),
+	}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, o := range page.Contents {
+			if strings.HasPrefix(*o.Key, QUARANTINE_PREFIX) {
+				continue
+			}
+			fn(*o.Key, *o.Size, aws.TimeValue(o.LastModified))
+		}
+		return true
+	})
+}
+
+// Quarantine moves an object out of the way, so it is never served again
+func (c *S3Cache) Quarantine(cid string) error {
+	err := c.Rename(cid, QUARANTINE_PREFIX+cid)
+	if err != nil {
+		c.log.WithField("cid", cid).Error("Failed to quarantine object: ", err)
+	}
+	return err
+}
+
+// Rename moves the object from to the name to
+func (c *S3Cache) Rename(from string, to string) error {
+	bucket := aws.String(c.config.Bucket)
+	_, err := c.s3client.CopyObject(&s3.CopyObjectInput{
+		Bucket:     bucket,
+		CopySource: aws.String(c.config.Bucket + "/" + from),
+		Key:        aws.String(to),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.s3client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: bucket,
+		Key:    aws.String(from),
+	})
+	return err
+}
+
+
+func (c *S3Cache) StoreFile(cid string, reader io.ReadSeeker) error {
 	key := aws.String(cid)
 	bucket := aws.String(c.config.Bucket)
+	// store the type, so it is correct when clients download directly
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(reader, head)
+	if _, err := reader.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
 	_, err := c.s3client.PutObject(&s3.PutObjectInput{
-		Body:   reader,
-		Bucket: bucket,
-		Key:    key,
+		Body:        reader,
+		Bucket:      bucket,
+		Key:         key,
+		ContentType: aws.String(DetectType(head[:n])),
 	})
 	if err != nil {
 		c.log.Errorf("Failed to upload data to %s/%s, %s\n", *bucket, *key, err.Error())
-		return
+		return err
 	}
 	c.log.WithField("cid",cid).WithField("bucket",c.config.Bucket).Trace("Upload Successful")
+	return nil
 }
 
-func (c *S3Cache) Uncache(cid string) {
+func (c *S3Cache) Uncache(cid string) error {
 	key := aws.String(cid)
 	bucket := aws.String(c.config.Bucket)
-	c.s3client.DeleteObject(&s3.DeleteObjectInput{
+	_, err := c.s3client.DeleteObject(&s3.DeleteObjectInput{
 		Bucket: bucket,
 		Key: key,
 	})
+	if err != nil {
+		c.log.WithField("cid", cid).Error("Failed to remove object: ", err)
+	}
+	return err
 }
\ No newline at end of file
@@ -0,0 +1,18 @@
+package cache
+
+import (
+	"github.com/h2non/filetype"
+	"net/http"
+)
+
+// DetectType guesses the mime type from the first bytes of a file
+func DetectType(buf []byte) string {
+	if len(buf) > 512 {
+		buf = buf[:512]
+	}
+	if kind, err := filetype.Match(buf); err == nil && kind != filetype.Unknown {
+		return kind.MIME.Value
+	}
+	// falls back to text or application/octet-stream
+	return http.DetectContentType(buf)
+}
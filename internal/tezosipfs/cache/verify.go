@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	chunker "github.com/ipfs/go-ipfs-chunker"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs/importer/balanced"
+	"github.com/ipfs/go-unixfs/importer/helpers"
+	"github.com/multiformats/go-multihash"
+)
+
+var ErrIntegrity = errors.New("cached content does not match its cid")
+
+// ErrUnverifiable is returned with the data if the hash could not be checked at all
+var ErrUnverifiable = errors.New("cached content can not be verified")
+
+/*
+ * Verify checks that data hashes to the multihash in key,
+ * key is a cid or a key as returned by common.CidKey.
+ * We have no idea how the content was imported originally, so we try
+ * the layouts that cover almost everything on the network: a single
+ * raw block, and a default UnixFS import as CIDv0, and as CIDv1 with
+ * and without raw leaves (go-ipfs and ipfs-lite defaults).
+ * If none of them matches, the content may still be fine but imported
+ * differently, that is ErrUnverifiable. Only a raw cid can mismatch.
+ */
+func Verify(key string, data []byte) (bool, error) {
+	var want multihash.Multihash
+	codec := uint64(0)
+	if c, err := cid.Decode(key); err == nil {
+		want = c.Hash()
+		codec = c.Type()
+	} else if want, err = multihash.FromB58String(key); err != nil {
+		return false, err
+	}
+	dec, err := multihash.Decode(want)
+	if err != nil {
+		return false, err
+	}
+
+	// single block
+	raw, err := multihash.Sum(data, dec.Code, dec.Length)
+	if err == nil && bytes.Equal(raw, want) {
+		return true, nil
+	}
+	if codec == cid.Raw {
+		return false, nil
+	}
+
+	// unixfs files
+	for _, l := range layouts {
+		if l.version == 0 && dec.Code != multihash.SHA2_256 {
+			continue
+		}
+		root, err := importRoot(data, l.version, l.rawLeaves, dec.Code)
+		if err != nil {
+			return false, err
+		}
+		if bytes.Equal(root.Hash(), want) {
+			return true, nil
+		}
+	}
+	return false, ErrUnverifiable
+}
+
+type layout struct {
+	version   uint64
+	rawLeaves bool
+}
+
+var layouts = []layout{
+	{0, false}, // go-ipfs default
+	{1, false}, // ipfs-lite AddFile default
+	{1, true},  // go-ipfs --cid-version=1
+}
+
+func importRoot(data []byte, version uint64, rawLeaves bool, mhType uint64) (cid.Cid, error) {
+	prefix := cid.Prefix{
+		Version:  version,
+		Codec:    cid.DagProtobuf,
+		MhType:   mhType,
+		MhLength: -1,
+	}
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	params := helpers.DagBuilderParams{
+		Dagserv:    merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs))),
+		RawLeaves:  rawLeaves,
+		Maxlinks:   helpers.DefaultLinksPerBlock,
+		CidBuilder: prefix,
+	}
+	db, err := params.New(chunker.DefaultSplitter(bytes.NewReader(data)))
+	if err != nil {
+		return cid.Undef, err
+	}
+	n, err := balanced.Layout(db)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return n.Cid(), nil
+}
@@ -0,0 +1,99 @@
+package cache
+
+import (
+	"bytes"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	chunker "github.com/ipfs/go-ipfs-chunker"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs/importer/balanced"
+	"github.com/ipfs/go-unixfs/importer/helpers"
+	"github.com/multiformats/go-multihash"
+	"math/rand"
+	"testing"
+)
+
+func payload(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+// add imports data the way go-ipfs and ipfs-lite do with the given settings
+func add(t *testing.T, data []byte, prefix cid.Prefix, rawLeaves bool) cid.Cid {
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	params := helpers.DagBuilderParams{
+		Dagserv:    merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs))),
+		RawLeaves:  rawLeaves,
+		Maxlinks:   helpers.DefaultLinksPerBlock,
+		CidBuilder: prefix,
+	}
+	db, err := params.New(chunker.NewSizeSplitter(bytes.NewReader(data), chunker.DefaultBlockSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := balanced.Layout(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n.Cid()
+}
+
+func rawBlock(t *testing.T, data []byte) cid.Cid {
+	c, err := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: multihash.SHA2_256, MhLength: -1}.Sum(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestVerifyLayouts(t *testing.T) {
+	v0 := cid.Prefix{Version: 0, Codec: cid.DagProtobuf, MhType: multihash.SHA2_256, MhLength: -1}
+	v1 := cid.Prefix{Version: 1, Codec: cid.DagProtobuf, MhType: multihash.SHA2_256, MhLength: -1}
+	layouts := []struct {
+		name string
+		cid  func(t *testing.T, data []byte) cid.Cid
+	}{
+		{"raw block", rawBlock},
+		{"v0", func(t *testing.T, data []byte) cid.Cid { return add(t, data, v0, false) }},
+		{"v1 dag-pb leaves", func(t *testing.T, data []byte) cid.Cid { return add(t, data, v1, false) }},
+		{"v1 raw leaves", func(t *testing.T, data []byte) cid.Cid { return add(t, data, v1, true) }},
+	}
+	for _, l := range layouts {
+		for _, size := range []int{1000, 300000, 1 << 20} {
+			data := payload(size)
+			c := l.cid(t, data)
+			for _, key := range []string{c.String(), c.Hash().B58String()} {
+				ok, err := Verify(key, data)
+				if err != nil || !ok {
+					t.Errorf("%s, %d bytes, key %s: got %v, %v", l.name, size, key, ok, err)
+				}
+			}
+		}
+	}
+}
+
+func TestVerifyMismatch(t *testing.T) {
+	data := payload(300000)
+	other := payload(300001)[:300000]
+
+	c := add(t, data, cid.Prefix{Version: 1, Codec: cid.DagProtobuf, MhType: multihash.SHA2_256, MhLength: -1}, false)
+	// we can not tell corrupt content from an unknown layout
+	if ok, err := Verify(c.String(), other); ok || err != ErrUnverifiable {
+		t.Errorf("dag-pb: got %v, %v, want ErrUnverifiable", ok, err)
+	}
+	if ok, err := Verify(c.Hash().B58String(), other); ok || err != ErrUnverifiable {
+		t.Errorf("key: got %v, %v, want ErrUnverifiable", ok, err)
+	}
+	// a raw block has only one layout
+	if ok, err := Verify(rawBlock(t, data).String(), other); ok || err != nil {
+		t.Errorf("raw: got %v, %v, want a mismatch", ok, err)
+	}
+	if _, err := Verify("not a cid", data); err == nil {
+		t.Error("invalid key: want an error")
+	}
+}
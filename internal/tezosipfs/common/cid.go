@@ -0,0 +1,54 @@
+package common
+
+import (
+	"errors"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"strings"
+)
+
+var ErrEmptyCid = errors.New("empty cid")
+
+// ParseCid decodes a CIDv0 or CIDv1 string using go-cid.
+func ParseCid(s string) (cid.Cid, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return cid.Undef, ErrEmptyCid
+	}
+	return cid.Decode(s)
+}
+
+/*
+ * CidKey returns the key we use for caches, blocklists and db records.
+ * It is the base58 multihash of the content, so the v0 and v1 form
+ * of a CID map to the same object. A key is its own key.
+ */
+func CidKey(s string) (string, error) {
+	c, err := ParseCid(s)
+	if err == nil {
+		return c.Hash().B58String(), nil
+	}
+	// only sha2-256 keys decode as a cid, the others are bare multihashes
+	s = strings.TrimSpace(s)
+	if _, e := multihash.FromB58String(s); e == nil {
+		return s, nil
+	}
+	return "", err
+}
+
+// Original is the cid records keep next to key, empty if cid is the key itself
+func Original(cid string, key string) string {
+	cid = strings.TrimSpace(cid)
+	if cid == key {
+		return ""
+	}
+	return cid
+}
+
+// Ref is the cid to use on the network for a record stored under key
+func Ref(key string, original string) string {
+	if original != "" {
+		return original
+	}
+	return key
+}
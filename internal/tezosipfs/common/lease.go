@@ -0,0 +1,16 @@
+package common
+
+import (
+	"time"
+)
+
+// LaterLease merges two expiries, nil is permanent and always wins
+func LaterLease(a *time.Time, b *time.Time) *time.Time {
+	if a == nil || b == nil {
+		return nil
+	}
+	if a.After(*b) {
+		return a
+	}
+	return b
+}
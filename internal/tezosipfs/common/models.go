@@ -3,21 +3,39 @@ package common
 import "time"
 
 type Pin struct {
-	ID      int       `storm:"id,increment"`
-	Created time.Time `storm:"index"`
-	Cid     string    `storm:"unique"`
-	From    string    `storm:"index"`
-	Status  string    `storm:"index"`
-	Size    int64
+	ID       int       `storm:"id,increment"`
+	Created  time.Time `storm:"index"`
+	Cid      string    `storm:"unique"` // key, see CidKey
+	Original string    // cid as requested, empty if it is the key
+	From     string    `storm:"index"`
+	Status   string    `storm:"index"`
+	Size     int64
+	// retries, see PinManager.retry
+	Attempts    int
+	NextAttempt time.Time `storm:"index"`
+	LastError   string
+	// lease, zero is permanent, see PinManager.GC
+	Expires time.Time `storm:"index"`
 }
 
 type Cache struct {
-	ID      int       `storm:"id,increment"`
-	Created time.Time `storm:"index"`
-	Cid     string    `storm:"unique"`
-	From    string    `storm:"index"`
-	Status  string    `storm:"index"`
-	Size    int64
+	ID       int       `storm:"id,increment"`
+	Created  time.Time `storm:"index"`
+	Cid      string    `storm:"unique"` // key, see CidKey
+	Original string    // cid as requested, empty if it is the key
+	From     string    `storm:"index"`
+	Status   string    `storm:"index"`
+	Size     int64
+}
+
+// Ref is the cid to ask the network for
+func (p *Pin) Ref() string {
+	return Ref(p.Cid, p.Original)
+}
+
+// Ref is the cid to ask the network for
+func (c *Cache) Ref() string {
+	return Ref(c.Cid, c.Original)
 }
 
 type KeyValue struct {
@@ -25,3 +43,106 @@ type KeyValue struct {
 	Key   []byte `storm:"unique"`
 	Value []byte
 }
+
+type ScrubResult struct {
+	ID      int       `storm:"id,increment"`
+	Cid     string    `storm:"unique"`
+	Checked time.Time `storm:"index"`
+	Status  string    `storm:"index"` // ok, mismatch or error
+	Size    int64
+	Error   string
+}
+
+// PinAttempt is one try of the PinManager to pin a cid
+type PinAttempt struct {
+	ID       int       `storm:"id,increment"`
+	Cid      string    `storm:"index"`
+	Started  time.Time `storm:"index"`
+	Finished time.Time
+	Status   string
+	Error    string
+	Size     int64
+}
+
+// PinAck records that a peer confirmed storing a cid
+type PinAck struct {
+	ID       int       `storm:"id,increment"`
+	Cid      string    `storm:"index"`
+	Peer     string    `storm:"index"`
+	Received time.Time `storm:"index"`
+}
+
+// ServicePin is a request made through the pinning service api
+type ServicePin struct {
+	ID        int       `storm:"id,increment"`
+	RequestID string    `storm:"unique"`
+	Cid       string    `storm:"index"` // key, see CidKey
+	Original  string    // cid as requested
+	Name      string    `storm:"index"`
+	Origins   []string
+	Meta      map[string]string
+	Owner     string    `storm:"index"` // name of the access token
+	Created   time.Time `storm:"index"`
+}
+
+// RemotePin tracks a copy of a pin on a remote pinning service
+type RemotePin struct {
+	ID          int       `storm:"id,increment"`
+	Cid         string    `storm:"index"` // key, see CidKey
+	Original    string    // cid as requested, empty if it is the key
+	Service     string    `storm:"index"`
+	RequestID   string
+	Status      string    `storm:"index"`
+	Attempts    int
+	NextAttempt time.Time `storm:"index"`
+	LastError   string
+	Updated     time.Time
+}
+
+// Ref is the cid to ask the remote service for
+func (r *RemotePin) Ref() string {
+	return Ref(r.Cid, r.Original)
+}
+
+// Replication tracks the target replica count of content we announced
+type Replication struct {
+	ID            int       `storm:"id,increment"`
+	Cid           string    `storm:"unique"` // key, see CidKey
+	Original      string    // cid as announced, empty if it is the key
+	Target        int       // 0 uses the configured factor
+	Created       time.Time `storm:"index"`
+	Announced     time.Time
+	Announcements int
+	Expires       time.Time // lease, zero is permanent
+}
+
+// Ref is the cid to ask the network for
+func (r *Replication) Ref() string {
+	return Ref(r.Cid, r.Original)
+}
+
+// Challenge is one proof-of-storage check of a peer
+type Challenge struct {
+	ID       int       `storm:"id,increment"`
+	Peer     string    `storm:"index"`
+	Cid      string    `storm:"index"`
+	Block    string
+	Issued   time.Time `storm:"index"`
+	Passed   bool
+	Error    string
+	Duration time.Duration
+}
+
+// PeerStats sums up challenges and uptime of a storage peer
+type PeerStats struct {
+	ID                  int    `storm:"id,increment"`
+	Peer                string `storm:"unique"`
+	FirstSeen           time.Time
+	LastSeen            time.Time
+	Rounds              int // checks since FirstSeen
+	Online              int // checks the peer was online
+	Passed              int
+	Failed              int
+	ConsecutiveFailures int
+	LastChallenge       time.Time
+}
@@ -18,6 +18,9 @@ type Config struct {
 	PinManagerEnabled bool `yaml:"PinManagerEnabled"`
 	GatewayEnabled bool `yaml:"GatewayEnabled"`
 	Admin Admin `yaml:"Admin"`
+	PinningService PinningService `yaml:"PinningService"`
+	Replication Replication `yaml:"Replication"`
+	Network Network `yaml:"Network"`
 	log *logrus.Entry
 	Identity Identity
 	lock *sync.Mutex
@@ -34,7 +37,8 @@ func (c *Config) GetUpdates() chan *Config {
 }
 
 type IPFS struct {
-	API string `yaml:"API"`
+	API      string `yaml:"API"`
+	SwarmKey string `yaml:"SwarmKey"` // path of the swarm.key of the node, compared with Network.SwarmKey
 }
 
 type CORS struct {
@@ -42,12 +46,95 @@ type CORS struct {
 }
 
 type Uploads struct {
-	Enabled bool `yaml:"Enabled"`
-	MaxSize int  `yaml:"MaxSize"`
+	Enabled    bool `yaml:"Enabled"`
+	MaxSize    int  `yaml:"MaxSize"`
+	InlineSize int  `yaml:"InlineSize"` // KB, smaller files travel inside the pin request, 0 disables
 }
 
 type PinManager struct {
-	API string `yaml:"API"`
+	API       string `yaml:"API"`
+	Retry     Retry  `yaml:"Retry"`
+	Workers   int    `yaml:"Workers"`   // concurrent pins
+	MaxQueued int    `yaml:"MaxQueued"` // requests of one origin beyond this are dropped
+	// pinned content is replicated to these pinning services
+	RemoteServices []RemoteService `yaml:"RemoteServices"`
+	GC             GC              `yaml:"GC"`
+	Reconcile      Schedule        `yaml:"Reconcile"` // compare the db with the pins of the node
+}
+
+// GC unpins content whose lease expired and cleans up the backend
+type GC struct {
+	Enabled     bool `yaml:"Enabled"`
+	Interval    int  `yaml:"Interval"`    // minutes
+	GracePeriod int  `yaml:"GracePeriod"` // hours to keep content after its lease expired
+}
+
+// RemoteService is a provider of the IPFS Pinning Service API
+type RemoteService struct {
+	Name     string `yaml:"Name"`
+	Endpoint string `yaml:"Endpoint"`
+	Token    string `yaml:"Token"`
+}
+
+// Retry of failed and timed out pins, with exponential backoff
+type Retry struct {
+	MaxAttempts int `yaml:"MaxAttempts"`
+	Backoff     int `yaml:"Backoff"`    // seconds before the first retry
+	MaxBackoff  int `yaml:"MaxBackoff"` // seconds
+}
+
+// Network configures the embedded IPFS node, used if no Backend is set
+type Network struct {
+	Datastore   string      `yaml:"Datastore"` // path of the badger datastore
+	Listen      []string    `yaml:"Listen"`    // multiaddrs
+	Announce    []string    `yaml:"Announce"`  // multiaddrs told to peers instead of the listen addrs
+	Bootstrap   []string    `yaml:"Bootstrap"` // full multiaddrs, the public ipfs bootstrap peers if empty
+	Offline     bool        `yaml:"Offline"`   // LAN only: no public bootstrap peers, no NAT traversal or relays
+	SwarmKey    string      `yaml:"SwarmKey"`  // path of a swarm.key, only peers with the same key can connect
+	ConnManager ConnManager `yaml:"ConnManager"`
+	MDNS        MDNS        `yaml:"MDNS"`
+	// Name derives our pubsub topics, only nodes with the same name see our messages.
+	// Empty keeps the TEZOS_IPFS topic shared by every tipfs node
+	Name         string       `yaml:"Name"`
+	TopicPerKind bool         `yaml:"TopicPerKind"` // one topic per message kind instead of one for all
+	Federations  []Federation `yaml:"Federations"`  // further networks we take part in
+	// pubsub messages are signed, these are accepted within MessageWindow seconds of being sent
+	MessageWindow int          `yaml:"MessageWindow"`
+	AllowUnsigned bool         `yaml:"AllowUnsigned"` // accept messages of nodes without signatures
+	Pubsub        PubsubLimits `yaml:"Pubsub"`
+	MaxStorage    int          `yaml:"MaxStorage"`  // MB, 0 is unlimited
+	GCWatermark   int          `yaml:"GCWatermark"` // percent of MaxStorage that triggers a GC
+	GCInterval    int          `yaml:"GCInterval"`  // minutes between disk usage checks
+}
+
+// Federation is a further network with its own trust lists, see Network.Name
+type Federation struct {
+	Name         string `yaml:"Name"`
+	TopicPerKind bool   `yaml:"TopicPerKind"`
+	Peers        Peers  `yaml:"Peers"`
+}
+
+// PubsubLimits protect us from peers flooding the broadcast topic, 0 uses the defaults
+type PubsubLimits struct {
+	MaxMessageSize int     `yaml:"MaxMessageSize"` // KB, at most 1024
+	Rate           float64 `yaml:"Rate"`           // messages per second and sender
+	Burst          int     `yaml:"Burst"`          // messages a sender may send at once
+	BanAfter       int     `yaml:"BanAfter"`       // invalid messages before a sender is banned, -1 never bans
+	BanTime        int     `yaml:"BanTime"`        // minutes
+}
+
+// MDNS finds peers on the local network, useful without internet access
+type MDNS struct {
+	Enabled    bool   `yaml:"Enabled"`
+	Interval   int    `yaml:"Interval"`   // seconds between queries
+	ServiceTag string `yaml:"ServiceTag"` // the one of ipfs if empty
+}
+
+// ConnManager trims connections down to Low once we have more than High
+type ConnManager struct {
+	Low         int `yaml:"Low"`
+	High        int `yaml:"High"`
+	GracePeriod int `yaml:"GracePeriod"` // seconds new connections are kept
 }
 
 type Admin struct {
@@ -55,6 +142,30 @@ type Admin struct {
 	Port int `yaml:"Port"`
 }
 
+// Replication re-announces content that has fewer live copies than Factor
+type Replication struct {
+	Enabled    bool       `yaml:"Enabled"`
+	Factor     int        `yaml:"Factor"`   // default target, can be set per cid
+	Interval   int        `yaml:"Interval"` // minutes between checks
+	Challenges Challenges `yaml:"Challenges"`
+}
+
+// Challenges ask storage peers to prove they still store what they acknowledged
+type Challenges struct {
+	Enabled     bool `yaml:"Enabled"`
+	Interval    int  `yaml:"Interval"`    // minutes between rounds
+	Timeout     int  `yaml:"Timeout"`     // seconds to wait for a proof
+	MaxFailures int  `yaml:"MaxFailures"` // consecutive failures before a peer stops counting
+}
+
+// PinningService serves the IPFS Pinning Service API
+type PinningService struct {
+	Enabled      bool           `yaml:"Enabled"`
+	Host         string         `yaml:"Host"`
+	Port         int            `yaml:"Port"`
+	AccessTokens []AccessTokens `yaml:"AccessTokens"` // pins are owned by the name of the token
+}
+
 type Yaml2Go struct {
 	Gateway    Gateway    `yaml:"Gateway"`
 	Log        Log        `yaml:"Log"`
@@ -88,12 +199,30 @@ type Gateway struct {
 	Server     Server     `yaml:"Server"`
 	Storage    Storage    `yaml:"Storage"`
 	Backend    Backend    `yaml:"Backend"`
+	HotContent HotContent `yaml:"HotContent"`
+	Redirect   Redirect   `yaml:"Redirect"`
+}
+
+// Redirect cache hits to the bucket or a cdn instead of proxying them
+type Redirect struct {
+	Enabled  bool   `yaml:"Enabled"`
+	Expiry   int    `yaml:"Expiry"`   // seconds a presigned url is valid
+	CDN      string `yaml:"CDN"`      // base url, used instead of presigned urls if set
+	ScrubAge int    `yaml:"ScrubAge"` // hours a passed check allows redirects, 0 uses twice the scrub interval
+}
+
+type HotContent struct {
+	Share    bool `yaml:"Share"`    // broadcast our most requested cids
+	Prefetch bool `yaml:"Prefetch"` // cache what peers in CacheFor share
+	TopN     int  `yaml:"TopN"`
+	Interval int  `yaml:"Interval"` // minutes
 }
 
 type Server struct {
 	Port         int            `yaml:"Port"`
 	AccessTokens []AccessTokens `yaml:"AccessTokens"`
 	UploadToken  []AccessTokens  `yaml:"UploadToken"`
+	CacheIndex   bool           `yaml:"CacheIndex"` // serve the list of cached cids, public unless AccessTokens are set
 }
 
 type AccessTokens struct {
@@ -102,8 +231,16 @@ type AccessTokens struct {
 }
 
 type Storage struct {
-	S3     S3     `yaml:"s3"`
-	Folder string `yaml:"Folder"`
+	S3        S3       `yaml:"s3"`
+	Folder    string   `yaml:"Folder"`
+	Verify    bool     `yaml:"Verify"`
+	Scrub     Schedule `yaml:"Scrub"`
+	Reconcile Schedule `yaml:"Reconcile"`
+}
+
+type Schedule struct {
+	Enabled  bool `yaml:"Enabled"`
+	Interval int  `yaml:"Interval"` // hours
 }
 
 type DB struct {
@@ -123,6 +260,16 @@ type Peers struct {
 	CacheFor     []string `yaml:"CacheFor"`
 	PinFor       []string `yaml:"PinFor"`
 	TrustedPeers []string `yaml:"TrustedPeers"`
+	// limits for what we pin for peers in PinFor
+	Quotas       []Quota `yaml:"Quotas"`
+	DefaultQuota Quota   `yaml:"DefaultQuota"`
+}
+
+// Quota of a PinFor peer, 0 is unlimited
+type Quota struct {
+	Peer       string `yaml:"Peer"`
+	MaxBytes   int64  `yaml:"MaxBytes"`
+	MaxObjects int    `yaml:"MaxObjects"`
 }
 
 
@@ -137,7 +284,7 @@ func NewConfig() *Config{
 	viper.AddConfigPath("./config")
 	err := viper.ReadInConfig()
 	if err != nil {
-		fmt.Errorf("Fatal error config file: %s \n", err)
+		fmt.Printf("Fatal error config file: %s \n", err)
 		os.Exit(1)
 	}
 	c := Config{}
@@ -150,14 +297,14 @@ func NewConfig() *Config{
 		defer c.lock.Unlock()
 		err = viper.Unmarshal(&c)
 		if err != nil {
-			fmt.Println("unable to decode into struct, %v", err)
+			fmt.Printf("unable to decode into struct, %v\n", err)
 			os.Exit(1)
 		}
 
 	})
 	err = viper.Unmarshal(&c)
 	if err != nil {
-		fmt.Println("unable to decode into struct, %v", err)
+		fmt.Printf("unable to decode into struct, %v\n", err)
 		os.Exit(1)
 	}
 	return &c
@@ -27,3 +27,22 @@ func (c *Config) GetIpfsAPI() *string {
 	// run our own libp2p instance
 	return res
 }
+
+// Federations are the networks we take part in, the first one is set up by Network and Peers.
+// Of federations with the same name only the first one counts
+func (c *Config) Federations() []Federation {
+	res := []Federation{{
+		Name:         c.Network.Name,
+		TopicPerKind: c.Network.TopicPerKind,
+		Peers:        c.Peers,
+	}}
+	seen := map[string]bool{c.Network.Name: true}
+	for _, f := range c.Network.Federations {
+		if seen[f.Name] {
+			continue
+		}
+		seen[f.Name] = true
+		res = append(res, f)
+	}
+	return res
+}
@@ -2,9 +2,11 @@ package db
 
 import (
 	"github.com/asdine/storm/v3"
+	"github.com/asdine/storm/v3/q"
 	"github.com/sirupsen/logrus"
 	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/common"
 	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/config"
+	"time"
 )
 
 type StormDB struct {
@@ -23,6 +25,10 @@ func NewStormDB(c *config.Config, l *logrus.Entry) *StormDB {
 	}
 
 	d.storm = db
+	if err := d.migrateKeys(); err != nil {
+		d.log.Fatal("Failed to migrate records to multihash keys: ", err)
+		return nil
+	}
 
 	return &d
 }
@@ -65,6 +71,49 @@ func (d *StormDB) PaginatedGetAllPin(pagesize, page int) ([]common.Pin, error) {
 	return pins, err
 }
 
+// PinsByStatus returns all pins in any of the given states
+func (d *StormDB) PinsByStatus(status ...string) ([]common.Pin, error) {
+	var pins []common.Pin
+	err := d.storm.Select(q.In("Status", status)).Find(&pins)
+	if err == storm.ErrNotFound {
+		return []common.Pin{}, nil
+	}
+	return pins, err
+}
+
+// DuePins returns pins in any of the given states that should be retried by now
+func (d *StormDB) DuePins(now time.Time, status ...string) ([]common.Pin, error) {
+	var pins []common.Pin
+	err := d.storm.Select(q.In("Status", status), q.Lte("NextAttempt", now)).OrderBy("NextAttempt").Find(&pins)
+	if err == storm.ErrNotFound {
+		return []common.Pin{}, nil
+	}
+	return pins, err
+}
+
+// ExpiredPins returns pins with a lease that ended before t
+func (d *StormDB) ExpiredPins(t time.Time) ([]common.Pin, error) {
+	var pins []common.Pin
+	err := d.storm.Select(q.Gt("Expires", time.Time{}), q.Lte("Expires", t)).OrderBy("Expires").Find(&pins)
+	if err == storm.ErrNotFound {
+		return []common.Pin{}, nil
+	}
+	return pins, err
+}
+
+// OriginUsage sums up size and count of the pins we keep for an origin
+func (d *StormDB) OriginUsage(from string) (int64, int, error) {
+	var bytes int64
+	count := 0
+	inactive := []string{"expired", "blocked", "failed", "rejected", "removed"}
+	err := d.storm.Select(q.Eq("From", from), q.Not(q.In("Status", inactive))).Each(new(common.Pin), func(record interface{}) error {
+		bytes += record.(*common.Pin).Size
+		count++
+		return nil
+	})
+	return bytes, count, err
+}
+
 func (d *StormDB) IsBlocked(cid string) bool {
 	p, err := d.GetPin(cid)
 	if err != nil {
@@ -76,7 +125,14 @@ func (d *StormDB) IsBlocked(cid string) bool {
 	return false
 }
 
+// SaveCache updates the existing record for p.Cid if there is one
 func (d *StormDB) SaveCache(p *common.Cache) error {
+	if p.ID == 0 {
+		existing := common.Cache{}
+		if err := d.storm.One("Cid", p.Cid, &existing); err == nil {
+			p.ID = existing.ID
+		}
+	}
 	return d.storm.Save(p)
 }
 
@@ -96,6 +152,25 @@ func (d *StormDB) PaginatedGetAllCache(pagesize, page int) ([]common.Cache, erro
 	return Caches, err
 }
 
+// EachCache calls fn for every cache record, stops on the first error
+func (d *StormDB) EachCache(fn func(c *common.Cache) error) error {
+	return d.storm.Select().Each(new(common.Cache), func(record interface{}) error {
+		return fn(record.(*common.Cache))
+	})
+}
+
+// CachedCids returns every cid that is currently in the cache
+func (d *StormDB) CachedCids() ([]string, error) {
+	res := []string{}
+	err := d.EachCache(func(c *common.Cache) error {
+		if c.Status == "cached" {
+			res = append(res, c.Ref())
+		}
+		return nil
+	})
+	return res, err
+}
+
 func (d *StormDB) Cached(cid string) bool {
 	p, err := d.GetCache(cid)
 	if err != nil {
@@ -106,3 +181,170 @@ func (d *StormDB) Cached(cid string) bool {
 	}
 	return false
 }
+
+// SaveScrubResult keeps only the latest result per cid
+func (d *StormDB) SaveScrubResult(r *common.ScrubResult) error {
+	existing := common.ScrubResult{}
+	if err := d.storm.One("Cid", r.Cid, &existing); err == nil {
+		r.ID = existing.ID
+	}
+	return d.storm.Save(r)
+}
+
+func (d *StormDB) GetScrubResult(cid string) (*common.ScrubResult, error) {
+	obj := common.ScrubResult{}
+	e := d.storm.One("Cid", cid, &obj)
+	return &obj, e
+}
+
+func (d *StormDB) SavePinAttempt(a *common.PinAttempt) error {
+	return d.storm.Save(a)
+}
+
+func (d *StormDB) GetPinAttempts(cid string) ([]common.PinAttempt, error) {
+	attempts := []common.PinAttempt{}
+	err := d.storm.Select(q.Eq("Cid", cid)).OrderBy("Started").Find(&attempts)
+	if err == storm.ErrNotFound {
+		return []common.PinAttempt{}, nil
+	}
+	return attempts, err
+}
+
+// SavePinAck keeps one ack per cid and peer, with the latest time
+func (d *StormDB) SavePinAck(a *common.PinAck) error {
+	existing := common.PinAck{}
+	err := d.storm.Select(q.Eq("Cid", a.Cid), q.Eq("Peer", a.Peer)).First(&existing)
+	if err == nil {
+		a.ID = existing.ID
+	}
+	return d.storm.Save(a)
+}
+
+func (d *StormDB) GetPinAcks(cid string) ([]common.PinAck, error) {
+	acks := []common.PinAck{}
+	err := d.storm.Find("Cid", cid, &acks)
+	if err == storm.ErrNotFound {
+		return []common.PinAck{}, nil
+	}
+	return acks, err
+}
+
+// SaveReplication keeps one record per cid
+func (d *StormDB) SaveReplication(r *common.Replication) error {
+	if r.ID == 0 {
+		if existing, err := d.GetReplication(r.Cid); err == nil {
+			r.ID = existing.ID
+		}
+	}
+	return d.storm.Save(r)
+}
+
+func (d *StormDB) GetReplication(cid string) (*common.Replication, error) {
+	obj := common.Replication{}
+	e := d.storm.One("Cid", cid, &obj)
+	return &obj, e
+}
+
+func (d *StormDB) RemoveReplication(r *common.Replication) error {
+	return d.storm.DeleteStruct(r)
+}
+
+func (d *StormDB) Replications() ([]common.Replication, error) {
+	res := []common.Replication{}
+	err := d.storm.All(&res)
+	return res, err
+}
+
+func (d *StormDB) SaveChallenge(c *common.Challenge) error {
+	return d.storm.Save(c)
+}
+
+// GetChallenges returns the latest challenges of peer, newest first
+func (d *StormDB) GetChallenges(peer string, limit int) ([]common.Challenge, error) {
+	res := []common.Challenge{}
+	err := d.storm.Select(q.Eq("Peer", peer)).OrderBy("Issued").Reverse().Limit(limit).Find(&res)
+	if err == storm.ErrNotFound {
+		return []common.Challenge{}, nil
+	}
+	return res, err
+}
+
+func (d *StormDB) GetPeerStats(peer string) (*common.PeerStats, error) {
+	obj := common.PeerStats{}
+	e := d.storm.One("Peer", peer, &obj)
+	return &obj, e
+}
+
+func (d *StormDB) SavePeerStats(s *common.PeerStats) error {
+	return d.storm.Save(s)
+}
+
+func (d *StormDB) AllPeerStats() ([]common.PeerStats, error) {
+	res := []common.PeerStats{}
+	err := d.storm.All(&res)
+	return res, err
+}
+
+// SaveRemotePin keeps one record per cid and service
+func (d *StormDB) SaveRemotePin(r *common.RemotePin) error {
+	if r.ID == 0 {
+		existing := common.RemotePin{}
+		err := d.storm.Select(q.Eq("Cid", r.Cid), q.Eq("Service", r.Service)).First(&existing)
+		if err == nil {
+			r.ID = existing.ID
+		}
+	}
+	return d.storm.Save(r)
+}
+
+func (d *StormDB) RemoveRemotePin(r *common.RemotePin) error {
+	return d.storm.DeleteStruct(r)
+}
+
+func (d *StormDB) GetRemotePins(cid string) ([]common.RemotePin, error) {
+	pins := []common.RemotePin{}
+	err := d.storm.Find("Cid", cid, &pins)
+	if err == storm.ErrNotFound {
+		return []common.RemotePin{}, nil
+	}
+	return pins, err
+}
+
+// DueRemotePins returns remote pins in status that are due at now
+func (d *StormDB) DueRemotePins(now time.Time, status ...string) ([]common.RemotePin, error) {
+	var pins []common.RemotePin
+	err := d.storm.Select(q.In("Status", status), q.Lte("NextAttempt", now)).OrderBy("NextAttempt").Find(&pins)
+	if err == storm.ErrNotFound {
+		return []common.RemotePin{}, nil
+	}
+	return pins, err
+}
+
+func (d *StormDB) SaveServicePin(p *common.ServicePin) error {
+	return d.storm.Save(p)
+}
+
+func (d *StormDB) RemoveServicePin(p *common.ServicePin) error {
+	return d.storm.DeleteStruct(p)
+}
+
+func (d *StormDB) GetServicePin(requestID string) (*common.ServicePin, error) {
+	obj := common.ServicePin{}
+	e := d.storm.One("RequestID", requestID, &obj)
+	return &obj, e
+}
+
+// ServicePins returns all requests of owner, newest first
+func (d *StormDB) ServicePins(owner string) ([]common.ServicePin, error) {
+	pins := []common.ServicePin{}
+	err := d.storm.Select(q.Eq("Owner", owner)).OrderBy("Created").Reverse().Find(&pins)
+	if err == storm.ErrNotFound {
+		return []common.ServicePin{}, nil
+	}
+	return pins, err
+}
+
+// CountServicePins counts requests of all owners for a cid key
+func (d *StormDB) CountServicePins(cid string) (int, error) {
+	return d.storm.Select(q.Eq("Cid", cid)).Count(&common.ServicePin{})
+}
@@ -0,0 +1,97 @@
+package db
+
+import (
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/common"
+)
+
+const MIGRATIONS_BUCKET = "migrations"
+
+// Migrated is true once the migration name ran to completion
+func (d *StormDB) Migrated(name string) bool {
+	done := false
+	d.storm.Get(MIGRATIONS_BUCKET, name, &done)
+	return done
+}
+
+func (d *StormDB) SetMigrated(name string) error {
+	return d.storm.Set(MIGRATIONS_BUCKET, name, true)
+}
+
+/*
+ * migrateKeys re-keys pins and cache records stored under the cid string,
+ * from before we keyed everything by multihash, see common.CidKey.
+ * If both forms of a cid have a record, the keyed one is kept, a block
+ * always wins. Records of invalid cids stay as they are.
+ */
+func (d *StormDB) migrateKeys() error {
+	if d.Migrated("keys") {
+		return nil
+	}
+	moved := 0
+	var pins []common.Pin
+	if err := d.storm.All(&pins); err != nil {
+		return err
+	}
+	for i := range pins {
+		p := &pins[i]
+		key, err := common.CidKey(p.Cid)
+		if err != nil || key == p.Cid {
+			continue
+		}
+		moved++
+		if existing, err := d.GetPin(key); err == nil {
+			if p.Status == "blocked" {
+				existing.Status = "blocked"
+			}
+			if existing.Original == "" {
+				existing.Original = p.Cid
+			}
+			if err := d.storm.Save(existing); err != nil {
+				return err
+			}
+			if err := d.storm.DeleteStruct(p); err != nil {
+				return err
+			}
+			continue
+		}
+		p.Original = p.Cid
+		p.Cid = key
+		if err := d.storm.Save(p); err != nil {
+			return err
+		}
+	}
+
+	var caches []common.Cache
+	if err := d.storm.All(&caches); err != nil {
+		return err
+	}
+	for i := range caches {
+		c := &caches[i]
+		key, err := common.CidKey(c.Cid)
+		if err != nil || key == c.Cid {
+			continue
+		}
+		moved++
+		if existing, err := d.GetCache(key); err == nil {
+			if existing.Original == "" {
+				existing.Original = c.Cid
+			}
+			if err := d.storm.Save(existing); err != nil {
+				return err
+			}
+			if err := d.storm.DeleteStruct(c); err != nil {
+				return err
+			}
+			continue
+		}
+		c.Original = c.Cid
+		c.Cid = key
+		if err := d.storm.Save(c); err != nil {
+			return err
+		}
+	}
+	if moved > 0 {
+		d.log.WithField("records", moved).Info("Migrated records to multihash keys")
+	}
+	return d.SetMigrated("keys")
+}
@@ -0,0 +1,102 @@
+package db
+
+import (
+	"github.com/asdine/storm/v3"
+	"github.com/asdine/storm/v3/q"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/common"
+	"time"
+)
+
+// Filter for listing pins and cache entries, zero values match everything
+type Filter struct {
+	Status   string
+	From     string
+	Since    time.Time
+	Until    time.Time
+	OrderBy  string // Created, Size, Cid or Status
+	Reverse  bool
+	Page     int // starts at 1
+	PageSize int
+}
+
+type Totals struct {
+	Count int
+	Bytes int64
+}
+
+var sortable = map[string]bool{"Created": true, "Size": true, "Cid": true, "Status": true}
+
+func (f Filter) matchers() []q.Matcher {
+	m := []q.Matcher{}
+	if f.Status != "" {
+		m = append(m, q.Eq("Status", f.Status))
+	}
+	if f.From != "" {
+		m = append(m, q.Eq("From", f.From))
+	}
+	if !f.Since.IsZero() {
+		m = append(m, q.Gte("Created", f.Since))
+	}
+	if !f.Until.IsZero() {
+		m = append(m, q.Lte("Created", f.Until))
+	}
+	return m
+}
+
+func (d *StormDB) query(f Filter) storm.Query {
+	query := d.storm.Select(f.matchers()...)
+	if sortable[f.OrderBy] {
+		query = query.OrderBy(f.OrderBy)
+	} else {
+		query = query.OrderBy("Created")
+	}
+	if f.Reverse {
+		query = query.Reverse()
+	}
+	if f.PageSize > 0 {
+		page := f.Page
+		if page < 1 {
+			page = 1
+		}
+		query = query.Skip(f.PageSize * (page - 1)).Limit(f.PageSize)
+	}
+	return query
+}
+
+// FindPins returns one page of pins, the totals cover all pins matching the filter
+func (d *StormDB) FindPins(f Filter) ([]common.Pin, Totals, error) {
+	pins := []common.Pin{}
+	totals := Totals{}
+	err := d.storm.Select(f.matchers()...).Each(new(common.Pin), func(record interface{}) error {
+		totals.Count++
+		totals.Bytes += record.(*common.Pin).Size
+		return nil
+	})
+	if err != nil {
+		return pins, totals, err
+	}
+	err = d.query(f).Find(&pins)
+	if err == storm.ErrNotFound {
+		return []common.Pin{}, totals, nil
+	}
+	return pins, totals, err
+}
+
+// FindCache returns one page of cache entries, the totals cover all entries matching the filter
+func (d *StormDB) FindCache(f Filter) ([]common.Cache, Totals, error) {
+	entries := []common.Cache{}
+	totals := Totals{}
+	err := d.storm.Select(f.matchers()...).Each(new(common.Cache), func(record interface{}) error {
+		totals.Count++
+		totals.Bytes += record.(*common.Cache).Size
+		return nil
+	})
+	if err != nil {
+		return entries, totals, err
+	}
+	err = d.query(f).Find(&entries)
+	if err == storm.ErrNotFound {
+		return []common.Cache{}, totals, nil
+	}
+	return entries, totals, err
+}
@@ -2,25 +2,25 @@ package network
 
 import (
 	"context"
-	"encoding/json"
-	"github.com/google/uuid"
-	lru "github.com/hashicorp/golang-lru"
+	"github.com/ipfs/go-datastore"
 	ipfslite "github.com/hsanjuan/ipfs-lite"
 	"github.com/ipfs/go-cid"
-	"github.com/libp2p/go-libp2p"
 	connmgr "github.com/libp2p/go-libp2p-connmgr"
 	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/protocol"
 	dht2 "github.com/libp2p/go-libp2p-kad-dht"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
-	libp2pquic "github.com/libp2p/go-libp2p-quic-transport"
 	"github.com/multiformats/go-multiaddr"
 	"github.com/sirupsen/logrus"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/config"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/pinset"
 	"io"
 	"sync"
-	"time"
+	"sync/atomic"
 )
 
 type Lightclient struct {
@@ -32,34 +32,44 @@ type Lightclient struct {
 	dht              *dht2.IpfsDHT
 	pubsub           *pubsub.PubSub
 	floodsub         *pubsub.PubSub
-	topic            *pubsub.Topic
-	ftopic           *pubsub.Topic
-	pubsubscriptions []chan *PubSubMessage
-	msgcache         *lru.Cache
+	topics           map[string]*pubsub.Topic // by name, of all our federations
+	ftopics          map[string]*pubsub.Topic
+	feds             []*federation
+	bus              *Bus
+	signer           *signer
+	guard            *guard
 	cm               *connmgr.BasicConnMgr
+	c                *config.Config
+	ds               datastore.Batching
+	gcLock           *sync.RWMutex // pins hold the read lock, the gc the write lock
+	pinset           *pinset.Pinset
+	peers            map[string]*PeerInfo
+	pl               *sync.Mutex // guards peers and connected
 }
 
-var options = []libp2p.Option{
-	libp2p.NATPortMap(),
-	libp2p.EnableAutoRelay(),
-	libp2p.EnableNATService(),
-	libp2p.Transport(libp2pquic.NewTransport),
-	libp2p.EnableAutoRelay(),
-	libp2p.DefaultTransports,
-}
-
-func NewLightclient(privkey []byte, log *logrus.Entry) *Lightclient {
+func NewLightclient(c *config.Config, privkey []byte, log *logrus.Entry) *Lightclient {
 	l := Lightclient{}
+	l.c = c
 	l.privkey = privkey
+	l.gcLock = &sync.RWMutex{}
+	l.peers = map[string]*PeerInfo{}
+	l.pl = &sync.Mutex{}
 	l.log = log.WithField("source", "light_client")
+	l.bus = NewBus(l.log)
+	l.feds = newFederations(c)
+	l.topics = map[string]*pubsub.Topic{}
+	l.ftopics = map[string]*pubsub.Topic{}
 	return &l
 }
 
 func (l *Lightclient) Setup() {
-	cm := connmgr.NewConnManager(20, 50, time.Minute)
-	options = append(options, libp2p.ConnectionManager(cm))
-	ctx, _ := context.WithCancel(context.Background())
-	ds, err := ipfslite.BadgerDatastore("/tmp/badger")
+	cm := l.connManager()
+	options, err := l.options(cm)
+	if err != nil {
+		l.log.Fatal("Invalid announce address: ", err)
+	}
+	ctx := context.Background()
+	ds, err := ipfslite.BadgerDatastore(l.datastorePath())
 	if err != nil {
 		l.log.Fatal(err)
 	}
@@ -67,51 +77,122 @@ func (l *Lightclient) Setup() {
 	if err != nil {
 		panic(err)
 	}
-	listen, _ := multiaddr.NewMultiaddr("/ip4/0.0.0.0/tcp/4005/")
-	listen2, _ := multiaddr.NewMultiaddr("/ip4/0.0.0.0/udp/4005/")
-	l.connected = map[string]bool{}
-	h, _, err := ipfslite.SetupLibp2p(
-		ctx,
-		priv,
-		nil,
-		[]multiaddr.Multiaddr{listen, listen2},
-		ds,
-		options...,
-	)
-	ps, err := pubsub.NewGossipSub(ctx, h)
-	ps2, err := pubsub.NewFloodSub(ctx, h)
+	l.signer, err = newSigner(l.c, l.privkey)
 	if err != nil {
 		panic(err)
 	}
-	l.pubsub = ps
-	l.floodsub = ps2
-	topic, err := ps.Join(BROADCAST_TOPIC)
-	topic2, err := ps2.Join(BROADCAST_TOPIC)
+	listen, err := l.listenAddrs()
 	if err != nil {
-		panic(err)
+		l.log.Fatal("Invalid listen address: ", err)
+	}
+	bootstrap, err := l.bootstrapPeers()
+	if err != nil {
+		l.log.Fatal("Invalid bootstrap peer: ", err)
+	}
+	l.connected = map[string]bool{}
+	var h host.Host
+	if l.private() {
+		psk, err := loadSwarmKey(l.c.Network.SwarmKey)
+		if err != nil {
+			l.log.Fatal("Can not read swarm key: ", err)
+		}
+		h, l.dht, err = l.setupPrivate(ctx, priv, psk, listen, ds, options)
+		if err != nil {
+			l.log.Fatal("Could not start the embedded node: ", err)
+		}
+	} else {
+		h, _, err = ipfslite.SetupLibp2p(
+			ctx,
+			priv,
+			nil,
+			listen,
+			ds,
+			options...,
+		)
+		if err != nil {
+			l.log.Fatal("Could not start the embedded node: ", err)
+		}
+		l.dht = dht2.NewDHT(context.Background(), h, ds)
+	}
+	l.guard = newGuard(l.c, l.log, l.signer, h.ID(), l.wanted)
+	for _, f := range l.feds {
+		for t, kind := range f.topics() {
+			l.guard.topics[t] = kind
+		}
+	}
+	psopts, err := l.guard.options()
+	if err != nil {
+		l.log.Fatal(err)
+	}
+	ps, err := pubsub.NewGossipSub(ctx, h, psopts...)
+	if err != nil {
+		l.log.Fatal("Could not start pubsub: ", err)
 	}
-	l.topic = topic
-	l.ftopic = topic2
-	dht := dht2.NewDHT(context.Background(), h, ds)
-	l.dht = dht
+	ps2, err := pubsub.NewFloodSub(ctx, h)
 	if err != nil {
 		panic(err)
 	}
-	lite, err := ipfslite.New(ctx, ds, h, dht, nil)
+	l.guard.ban = func(p peer.ID) {
+		l.peer(p) // so it shows up in Peers
+		ps.BlacklistPeer(p)
+		ps2.BlacklistPeer(p)
+	}
+	l.pubsub = ps
+	l.floodsub = ps2
+	for t := range l.guard.topics {
+		if err := ps.RegisterTopicValidator(t, l.guard.validate); err != nil {
+			l.log.Fatal(err)
+		}
+		topic, err := ps.Join(t)
+		if err != nil {
+			l.log.Fatal(err)
+		}
+		topic2, err := ps2.Join(t)
+		if err != nil {
+			l.log.Fatal(err)
+		}
+		l.topics[t] = topic
+		l.ftopics[t] = topic2
+	}
+	lite, err := ipfslite.New(ctx, ds, h, l.dht, nil)
 	if err != nil {
 		l.log.Fatal(err)
 	}
-	l.msgcache, _ = lru.New(1500)
-	lite.Bootstrap(ipfslite.DefaultBootstrapPeers())
+	if len(bootstrap) > 0 {
+		lite.Bootstrap(bootstrap)
+	}
 	l.client = lite
 	l.h = h
 	l.cm = cm
+	l.ds = ds
+	l.pinset = pinset.New(ds)
+	if moved, err := l.pinset.Migrate(); err != nil {
+		l.log.Fatal("Failed to migrate pins to multihash keys: ", err)
+	} else if moved > 0 {
+		l.log.WithField("pins", moved).Info("Migrated pins to multihash keys")
+	}
+	// once, Connect runs periodically
+	for _, f := range l.feds {
+		for t := range f.topics() {
+			go l.listenPubsub(l.topics[t], f)
+		}
+	}
+	if l.c.Network.MaxStorage > 0 {
+		go l.gcLoop()
+	}
+	if l.c.Network.MDNS.Enabled {
+		l.setupMDNS(ctx)
+	}
 
 	l.log.Info("My peerID is: ", h.ID().String())
+	if l.private() {
+		l.log.Info("Private swarm, only peers with our swarm key can connect")
+	} else if l.c.Network.Offline {
+		l.log.Info("Offline mode, only connecting to local and configured peers")
+	}
 }
 
-func (l *Lightclient) GetFile(ctxorig context.Context, cidStr string) (io.Reader, error) {
-	ctx, _ := context.WithCancel(ctxorig)
+func (l *Lightclient) GetFile(ctx context.Context, cidStr string) (io.Reader, error) {
 	l.log.Trace("Get File: " + cidStr)
 	c, err := cid.Decode(cidStr)
 	if err != nil {
@@ -135,6 +216,16 @@ func (l *Lightclient) AddFile(source io.Reader) (string, error) {
 	return node.Cid().String(), nil
 }
 
+// Import adds without pinning, the next GC removes it unless it gets pinned
+func (l *Lightclient) Import(file io.Reader) (string, error) {
+	if err := l.checkStorage(); err != nil {
+		return "", err
+	}
+	l.gcLock.RLock()
+	defer l.gcLock.RUnlock()
+	return l.AddFile(file)
+}
+
 func (l *Lightclient) Connect(peers []string) error {
 	connected := make(chan struct{})
 	ctx := context.Background()
@@ -148,11 +239,15 @@ func (l *Lightclient) Connect(peers []string) error {
 			l.log.Warn("can not parse peerID: ", err)
 			continue
 		}
+		info := l.peer(p)
+		l.pl.Lock()
+		info.Wanted = true
+		l.pl.Unlock()
 		if l.cm.IsProtected(p, "tezos-ipfs") {
 			continue
 		}
 		go l.cm.Protect(p, "tezos-ipfs")
-		pinfo, err := l.dht.FindPeer(ctx, p)
+		pinfo, source, err := l.findPeer(ctx, p)
 		if err != nil {
 			l.log.Warn("error creating pinfo: ", err)
 			continue
@@ -166,10 +261,7 @@ func (l *Lightclient) Connect(peers []string) error {
 			if err != nil {
 				l.log.Warn(err)
 			} else {
-				if _, ok := l.connected[pinfo.ID.String()]; !ok {
-					l.log.Info("Connected with ", pinfo.ID)
-					l.connected[pinfo.ID.String()] = true
-				}
+				l.connectedVia(pinfo.ID, source)
 			}
 			connected <- struct{}{}
 		}(pinfo)
@@ -179,73 +271,169 @@ func (l *Lightclient) Connect(peers []string) error {
 		wg.Wait()
 		close(connected)
 	}()
-	go l.listenPubsub()
 
 	return nil
 }
 
+// SendMessage sends msg to all our federations
 func (l *Lightclient) SendMessage(msg *PubSubMessage) {
-	msg.Id = uuid.New().String()
-	data, _ := json.Marshal(msg)
-	l.topic.Publish(context.Background(), data)
-	l.ftopic.Publish(context.Background(), data)
+	l.publish(msg, nil)
 }
 
-func (l *Lightclient) listenPubsub() {
-	s, e := l.topic.Subscribe()
+// SendMessageTo sends msg to the federation network only
+func (l *Lightclient) SendMessageTo(network string, msg *PubSubMessage) {
+	l.publish(msg, &network)
+}
+
+func (l *Lightclient) publish(msg *PubSubMessage, to *string) {
+	for _, f := range targets(l.feds, to) {
+		// sealed for every federation, members of several get it from each
+		data, err := l.signer.seal(msg, l.ID())
+		if err != nil {
+			l.log.Error("Could not sign message: ", err)
+			return
+		}
+		t := f.topicOf(msg.Kind)
+		topic, ok := l.topics[t]
+		if !ok {
+			l.log.WithField("kind", msg.Kind).Error("no topic for message in federation ", f.name)
+			continue
+		}
+		topic.Publish(context.Background(), data)
+		l.ftopics[t].Publish(context.Background(), data)
+		atomic.AddUint64(&f.sent, 1)
+	}
+}
+
+func (l *Lightclient) listenPubsub(topic *pubsub.Topic, f *federation) {
+	s, e := topic.Subscribe()
 	if e != nil {
 		l.log.Fatal(e)
 	}
 	for {
 		msg, e := s.Next(context.Background())
 		if e != nil {
-			l.log.Warn(e)
+			// only fails once the subscription or pubsub is closed
+			l.log.WithField("topic", topic.String()).Warn("Subscription closed: ", e)
+			return
 		}
-		p, _ := peer.IDFromBytes(msg.From)
-		psmg := PubSubMessage{}
-		json.Unmarshal(msg.Data, &psmg)
-
-		if _, ok := l.msgcache.Get(psmg.Id); !ok {
-			l.msgcache.Add(psmg.Id, true)
-			psmg.From = p.String()
-			for _, c := range l.pubsubscriptions {
-				c <- &psmg
-			}
+		// the guard opened it while validating
+		psmg, ok := msg.ValidatorData.(*PubSubMessage)
+		if !ok {
+			continue
 		}
+		psmg.Network = f.name
+		atomic.AddUint64(&f.received, 1)
+		l.bus.Publish(psmg)
 	}
 }
 
-func (l *Lightclient) Subscribe() chan *PubSubMessage {
-	res := make(chan *PubSubMessage, 10)
-	l.pubsubscriptions = append(l.pubsubscriptions, res)
-	return res
+func (l *Lightclient) Federations() []FederationStats {
+	return federationStats(l.feds)
+}
+
+func (l *Lightclient) Events() *Bus {
+	return l.bus
 }
 
 func (l *Lightclient) ID() string {
 	return l.h.ID().String()
 }
 
+// Addrs returns our listen addresses including the /p2p/ part
+func (l *Lightclient) Addrs() []string {
+	res := []string{}
+	for _, a := range l.h.Addrs() {
+		res = append(res, a.String()+"/p2p/"+l.h.ID().String())
+	}
+	return res
+}
+
+// ConnectAddrs dials full multiaddrs, e.g. origins of a pin request
+func (l *Lightclient) ConnectAddrs(addrs []string) error {
+	var lastErr error
+	for _, a := range addrs {
+		ma, err := multiaddr.NewMultiaddr(a)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		pinfo, err := peer.AddrInfoFromP2pAddr(ma)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if err := l.h.Connect(context.Background(), *pinfo); err != nil {
+			l.log.WithField("addr", a).Trace("can not connect: ", err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// GetBlock returns the raw block, offline only looks at the local blockstore
+func (l *Lightclient) GetBlock(ctx context.Context, cidStr string, offline bool) ([]byte, error) {
+	c, err := cid.Decode(cidStr)
+	if err != nil {
+		return nil, err
+	}
+	if offline {
+		b, err := l.client.BlockStore().Get(c)
+		if err != nil {
+			return nil, err
+		}
+		return b.RawData(), nil
+	}
+	n, err := l.client.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return n.RawData(), nil
+}
+
+func (l *Lightclient) Links(ctx context.Context, cidStr string) ([]string, error) {
+	c, err := cid.Decode(cidStr)
+	if err != nil {
+		return nil, err
+	}
+	n, err := l.client.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	res := []string{}
+	for _, link := range n.Links() {
+		res = append(res, link.Cid.String())
+	}
+	return res, nil
+}
+
 func (l *Lightclient) UploadAndPin(file io.Reader) (string, error) {
+	if err := l.checkStorage(); err != nil {
+		return "", err
+	}
+	l.gcLock.RLock()
+	defer l.gcLock.RUnlock()
 	fnode, err := l.client.AddFile(context.Background(), file, nil)
 	if err != nil {
 		return "", err
 	}
-	c, _ := cid.Decode(fnode.Cid().String())
-	pinRequest := PubSubMessage{
-		Data: []byte(c.Hash().B58String()),
-		Kind: "new_object",
+	if err := l.pinset.Add(pinset.RECURSIVE, fnode.Cid()); err != nil {
+		return "", err
 	}
-	l.SendMessage(&pinRequest)
-	l.log.WithField("cid", c.Hash().B58String()).Trace("sending pin request")
-	return c.Hash().B58String(), err
+	return fnode.Cid().Hash().B58String(), nil
 }
 
-func (l *Lightclient) LocalPin(cid string) error {
-	l.log.Error("attempted to pin something on lightclient....")
-	return nil
+// OpenStream opens a direct stream to peer, the caller closes it
+func (l *Lightclient) OpenStream(ctx context.Context, peerID string, proto string) (io.ReadWriteCloser, error) {
+	p, err := peer.Decode(peerID)
+	if err != nil {
+		return nil, err
+	}
+	return l.h.NewStream(ctx, p, protocol.ID(proto))
 }
 
-func (l *Lightclient) RemovePin(cid string) error {
-	l.log.Error("attempted to unpin something on lightclient....")
-	return nil
+func (l *Lightclient) SetStreamHandler(proto string, handler StreamHandler) {
+	l.h.SetStreamHandler(protocol.ID(proto), func(s network.Stream) {
+		handler(s.Conn().RemotePeer().String(), s)
+	})
 }
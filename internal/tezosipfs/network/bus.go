@@ -0,0 +1,242 @@
+package network
+
+import (
+	"github.com/sirupsen/logrus"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Received messages are published on the event bus, one topic per Kind.
+ * Every subscriber has its own buffer, a full buffer only affects that
+ * subscriber: depending on its policy the new or the oldest event is
+ * dropped, or it waits a little before it is dropped. Block subscribers
+ * wait in a goroutine of their own, Publish never waits. Dropped events
+ * are counted, see Stats.
+ */
+
+type Policy int
+
+const (
+	DropNewest Policy = iota // default, events that do not fit are dropped
+	DropOldest               // makes room for the new event, for consumers that want the latest state
+	Block                    // backpressure, a second buffer where each event waits up to BLOCK_TIMEOUT
+)
+
+const (
+	DEFAULT_BUFFER = 64
+	BLOCK_TIMEOUT  = time.Second
+)
+
+func (p Policy) String() string {
+	switch p {
+	case DropOldest:
+		return "drop-oldest"
+	case Block:
+		return "block"
+	default:
+		return "drop-newest"
+	}
+}
+
+type SubscribeOptions struct {
+	Name   string   // shows up in the stats
+	Kinds  []string // topics, none subscribes to all of them
+	Buffer int      // 0 uses DEFAULT_BUFFER
+	Policy Policy
+}
+
+type Subscription struct {
+	C <-chan *PubSubMessage
+
+	bus       *Bus
+	ch        chan *PubSubMessage
+	in        chan *PubSubMessage // events waiting for a Block subscriber
+	done      chan struct{}
+	opts      SubscribeOptions
+	l         *sync.Mutex // serializes sends, so DropOldest does not race itself
+	closed    bool
+	delivered uint64
+	dropped   uint64
+}
+
+type SubscriptionStats struct {
+	Name      string
+	Kinds     []string
+	Policy    string
+	Buffer    int
+	Pending   int
+	Delivered uint64
+	Dropped   uint64
+}
+
+type Bus struct {
+	log    *logrus.Entry
+	l      *sync.RWMutex
+	topics map[string][]*Subscription // "" holds subscribers of every kind
+	subs   []*Subscription
+}
+
+func NewBus(log *logrus.Entry) *Bus {
+	return &Bus{
+		log:    log,
+		l:      &sync.RWMutex{},
+		topics: map[string][]*Subscription{},
+		subs:   []*Subscription{},
+	}
+}
+
+func (b *Bus) Subscribe(opts SubscribeOptions) *Subscription {
+	if opts.Buffer <= 0 {
+		opts.Buffer = DEFAULT_BUFFER
+	}
+	ch := make(chan *PubSubMessage, opts.Buffer)
+	s := &Subscription{
+		C:    ch,
+		bus:  b,
+		ch:   ch,
+		opts: opts,
+		l:    &sync.Mutex{},
+	}
+	b.l.Lock()
+	defer b.l.Unlock()
+	if len(opts.Kinds) == 0 {
+		b.topics[""] = append(b.topics[""], s)
+	}
+	for _, kind := range opts.Kinds {
+		b.topics[kind] = append(b.topics[kind], s)
+	}
+	b.subs = append(b.subs, s)
+	if opts.Policy == Block {
+		s.in = make(chan *PubSubMessage, opts.Buffer)
+		s.done = make(chan struct{})
+		go s.forward()
+	}
+	return s
+}
+
+// forward hands events of Block subscribers to C, so only this goroutine waits for a slow subscriber
+func (s *Subscription) forward() {
+	defer close(s.ch)
+	for msg := range s.in {
+		select {
+		case s.ch <- msg:
+			atomic.AddUint64(&s.delivered, 1)
+		case <-time.After(BLOCK_TIMEOUT):
+			atomic.AddUint64(&s.dropped, 1)
+		case <-s.done:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
+
+// Unsubscribe stops delivery and closes C
+func (s *Subscription) Unsubscribe() {
+	b := s.bus
+	b.l.Lock()
+	for kind, subs := range b.topics {
+		b.topics[kind] = without(subs, s)
+	}
+	b.subs = without(b.subs, s)
+	b.l.Unlock()
+
+	s.l.Lock()
+	defer s.l.Unlock()
+	if !s.closed {
+		s.closed = true
+		if s.in != nil {
+			// forward closes C once it is through
+			close(s.done)
+			close(s.in)
+			return
+		}
+		close(s.ch)
+	}
+}
+
+func without(subs []*Subscription, s *Subscription) []*Subscription {
+	res := []*Subscription{}
+	for _, sub := range subs {
+		if sub != s {
+			res = append(res, sub)
+		}
+	}
+	return res
+}
+
+// Publish hands msg to the subscribers of its kind without waiting
+func (b *Bus) Publish(msg *PubSubMessage) {
+	b.l.RLock()
+	subs := append([]*Subscription{}, b.topics[msg.Kind]...)
+	subs = append(subs, b.topics[""]...)
+	b.l.RUnlock()
+	for _, s := range subs {
+		if !s.send(msg) {
+			b.log.WithField("subscriber", s.opts.Name).WithField("kind", msg.Kind).Trace("event bus: dropping event")
+		}
+	}
+}
+
+func (s *Subscription) send(msg *PubSubMessage) bool {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.closed {
+		return true
+	}
+	if s.in != nil {
+		select {
+		case s.in <- msg:
+			// counted once forward delivers it
+			return true
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+			return false
+		}
+	}
+	select {
+	case s.ch <- msg:
+		atomic.AddUint64(&s.delivered, 1)
+		return true
+	default:
+	}
+	switch s.opts.Policy {
+	case DropOldest:
+		select {
+		case <-s.ch:
+		default:
+		}
+		select {
+		case s.ch <- msg:
+			atomic.AddUint64(&s.delivered, 1)
+		default:
+		}
+		// the oldest one is lost either way
+		atomic.AddUint64(&s.dropped, 1)
+		return false
+	}
+	atomic.AddUint64(&s.dropped, 1)
+	return false
+}
+
+func (b *Bus) Stats() []SubscriptionStats {
+	b.l.RLock()
+	defer b.l.RUnlock()
+	res := []SubscriptionStats{}
+	for _, s := range b.subs {
+		kinds := s.opts.Kinds
+		if kinds == nil {
+			kinds = []string{}
+		}
+		res = append(res, SubscriptionStats{
+			Name:      s.opts.Name,
+			Kinds:     kinds,
+			Policy:    s.opts.Policy.String(),
+			Buffer:    s.opts.Buffer,
+			Pending:   len(s.ch) + len(s.in),
+			Delivered: atomic.LoadUint64(&s.delivered),
+			Dropped:   atomic.LoadUint64(&s.dropped),
+		})
+	}
+	return res
+}
@@ -0,0 +1,127 @@
+package network
+
+import (
+	"context"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p/p2p/discovery"
+	"time"
+)
+
+/*
+ * Peers of the Peers config lists are found via the DHT, which needs
+ * internet access. With mDNS, peers on the same LAN announce themselves,
+ * we remember their addresses and connect to those we want right away.
+ */
+
+const (
+	SOURCE_DHT  = "dht"
+	SOURCE_MDNS = "mdns"
+	SOURCE_IPFS = "ipfs"
+)
+
+func (l *Lightclient) setupMDNS(ctx context.Context) {
+	interval := time.Duration(l.c.Network.MDNS.Interval) * time.Second
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	service, err := discovery.NewMdnsService(ctx, l.h, interval, l.c.Network.MDNS.ServiceTag)
+	if err != nil {
+		l.log.Error("Could not start mDNS discovery: ", err)
+		return
+	}
+	service.RegisterNotifee(l)
+	l.log.Info("mDNS discovery enabled")
+}
+
+// HandlePeerFound is called by mDNS for every peer on the LAN
+func (l *Lightclient) HandlePeerFound(pinfo peer.AddrInfo) {
+	if pinfo.ID == l.h.ID() {
+		return
+	}
+	l.h.Peerstore().AddAddrs(pinfo.ID, pinfo.Addrs, peerstore.TempAddrTTL)
+	info := l.peer(pinfo.ID)
+	l.pl.Lock()
+	info.Source = SOURCE_MDNS
+	wanted := info.Wanted
+	l.pl.Unlock()
+	if !wanted || l.h.Network().Connectedness(pinfo.ID) == network.Connected {
+		return
+	}
+	l.cm.Protect(pinfo.ID, "tezos-ipfs")
+	if err := l.h.Connect(context.Background(), pinfo); err != nil {
+		l.log.WithField("peer", pinfo.ID.String()).Trace("can not connect to mDNS peer: ", err)
+		return
+	}
+	l.connectedVia(pinfo.ID, SOURCE_MDNS)
+}
+
+// peer returns the status record of id, creating it if needed
+func (l *Lightclient) peer(id peer.ID) *PeerInfo {
+	l.pl.Lock()
+	defer l.pl.Unlock()
+	info, ok := l.peers[id.String()]
+	if !ok {
+		info = &PeerInfo{ID: id.String()}
+		l.peers[id.String()] = info
+	}
+	return info
+}
+
+// wanted peers are those of our config
+func (l *Lightclient) wanted(id peer.ID) bool {
+	l.pl.Lock()
+	defer l.pl.Unlock()
+	info, ok := l.peers[id.String()]
+	return ok && info.Wanted
+}
+
+func (l *Lightclient) connectedVia(id peer.ID, source string) {
+	info := l.peer(id)
+	l.pl.Lock()
+	defer l.pl.Unlock()
+	if !l.connected[id.String()] {
+		l.log.WithField("source", source).Info("Connected with ", id)
+	}
+	l.connected[id.String()] = true
+	info.Source = source
+}
+
+// findPeer prefers addresses we already know, e.g. from mDNS, over a DHT lookup
+func (l *Lightclient) findPeer(ctx context.Context, p peer.ID) (peer.AddrInfo, string, error) {
+	l.pl.Lock()
+	source := ""
+	if info, ok := l.peers[p.String()]; ok {
+		source = info.Source
+	}
+	l.pl.Unlock()
+	if addrs := l.h.Peerstore().Addrs(p); source == SOURCE_MDNS && len(addrs) > 0 {
+		return peer.AddrInfo{ID: p, Addrs: addrs}, SOURCE_MDNS, nil
+	}
+	pinfo, err := l.dht.FindPeer(ctx, p)
+	return pinfo, SOURCE_DHT, err
+}
+
+func (l *Lightclient) Peers() []PeerInfo {
+	l.pl.Lock()
+	defer l.pl.Unlock()
+	res := []PeerInfo{}
+	for _, info := range l.peers {
+		p, err := peer.Decode(info.ID)
+		if err != nil {
+			continue
+		}
+		status := *info
+		status.Addrs = []string{}
+		for _, a := range l.h.Peerstore().Addrs(p) {
+			status.Addrs = append(status.Addrs, a.String())
+		}
+		status.Connected = l.h.Network().Connectedness(p) == network.Connected
+		status.Protected = l.cm.IsProtected(p, "tezos-ipfs")
+		status.Banned = l.guard.Banned(p)
+		status.Score = l.guard.score(p)
+		res = append(res, status)
+	}
+	return res
+}
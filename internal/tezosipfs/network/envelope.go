@@ -0,0 +1,261 @@
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/config"
+	"google.golang.org/protobuf/encoding/protowire"
+	"sync"
+	"time"
+)
+
+/*
+ * Every pubsub message is wrapped in a signed envelope, protobuf encoded:
+ *
+ *   message Envelope { uint64 version = 1; bytes payload = 2; bytes signature = 3; }
+ *   message Payload  { string id = 1; string kind = 2; bytes data = 3;
+ *                      int64 timestamp = 4; string node = 5; bytes public_key = 6; }
+ *
+ * The signature covers the raw payload, so fields added later do not break
+ * older nodes. Node is the peer id of the sender on the network. If it is
+ * not the id of the signing key, the sender runs behind an external ipfs
+ * node: we then require the transport to agree on the node and remember
+ * the first key it used. Ids are nonces, a message is accepted once and
+ * only within the timestamp window.
+ */
+
+const ENVELOPE_VERSION = 1
+
+var (
+	ErrUnsigned       = errors.New("unsigned message")
+	ErrUnknownVersion = errors.New("unknown envelope version")
+	ErrBadSignature   = errors.New("invalid signature")
+	ErrStale          = errors.New("message outside of the timestamp window")
+	ErrReplay         = errors.New("replayed message")
+	ErrOrigin         = errors.New("sender does not match its key")
+)
+
+type signer struct {
+	key    crypto.PrivKey
+	pub    []byte
+	c      *config.Config
+	l      *sync.Mutex
+	nonces map[string]time.Time
+	purged time.Time
+	keys   map[string][]byte // first key seen for senders behind an external node
+}
+
+func newSigner(c *config.Config, privkey []byte) (*signer, error) {
+	key, err := crypto.UnmarshalPrivateKey(privkey)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := crypto.MarshalPublicKey(key.GetPublic())
+	if err != nil {
+		return nil, err
+	}
+	return &signer{
+		key:    key,
+		pub:    pub,
+		c:      c,
+		l:      &sync.Mutex{},
+		nonces: map[string]time.Time{},
+		purged: time.Now(),
+		keys:   map[string][]byte{},
+	}, nil
+}
+
+func (s *signer) window() time.Duration {
+	if s.c.Network.MessageWindow > 0 {
+		return time.Duration(s.c.Network.MessageWindow) * time.Second
+	}
+	return 5 * time.Minute
+}
+
+// seal signs msg as node and returns the wire format, msg gets a fresh Id
+func (s *signer) seal(msg *PubSubMessage, node string) ([]byte, error) {
+	msg.Id = uuid.New().String()
+	var payload []byte
+	payload = protowire.AppendTag(payload, 1, protowire.BytesType)
+	payload = protowire.AppendString(payload, msg.Id)
+	payload = protowire.AppendTag(payload, 2, protowire.BytesType)
+	payload = protowire.AppendString(payload, msg.Kind)
+	payload = protowire.AppendTag(payload, 3, protowire.BytesType)
+	payload = protowire.AppendBytes(payload, msg.Data)
+	payload = protowire.AppendTag(payload, 4, protowire.VarintType)
+	payload = protowire.AppendVarint(payload, uint64(time.Now().UnixNano()))
+	payload = protowire.AppendTag(payload, 5, protowire.BytesType)
+	payload = protowire.AppendString(payload, node)
+	payload = protowire.AppendTag(payload, 6, protowire.BytesType)
+	payload = protowire.AppendBytes(payload, s.pub)
+	sig, err := s.key.Sign(payload)
+	if err != nil {
+		return nil, err
+	}
+	var res []byte
+	res = protowire.AppendTag(res, 1, protowire.VarintType)
+	res = protowire.AppendVarint(res, ENVELOPE_VERSION)
+	res = protowire.AppendTag(res, 2, protowire.BytesType)
+	res = protowire.AppendBytes(res, payload)
+	res = protowire.AppendTag(res, 3, protowire.BytesType)
+	res = protowire.AppendBytes(res, sig)
+	return res, nil
+}
+
+// open verifies data received from the transport peer from
+func (s *signer) open(data []byte, from string) (*PubSubMessage, error) {
+	if len(data) > 0 && data[0] == '{' {
+		// nodes before the envelope sent plain json
+		if !s.c.Network.AllowUnsigned {
+			return nil, ErrUnsigned
+		}
+		msg := PubSubMessage{}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return nil, err
+		}
+		msg.From = from
+		if s.replayed(msg.Id) {
+			return nil, ErrReplay
+		}
+		return &msg, nil
+	}
+
+	var version uint64
+	var payload, sig []byte
+	err := parseFields(data, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			version = n
+		case num == 2 && typ == protowire.BytesType:
+			payload = v
+		case num == 3 && typ == protowire.BytesType:
+			sig = v
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if version != ENVELOPE_VERSION {
+		return nil, ErrUnknownVersion
+	}
+
+	msg := PubSubMessage{}
+	var ts int64
+	var pk []byte
+	err = parseFields(payload, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			msg.Id = string(v)
+		case num == 2 && typ == protowire.BytesType:
+			msg.Kind = string(v)
+		case num == 3 && typ == protowire.BytesType:
+			msg.Data = v
+		case num == 4 && typ == protowire.VarintType:
+			ts = int64(n)
+		case num == 5 && typ == protowire.BytesType:
+			msg.From = string(v)
+		case num == 6 && typ == protowire.BytesType:
+			pk = v
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pub, err := crypto.UnmarshalPublicKey(pk)
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := pub.Verify(payload, sig); err != nil || !ok {
+		return nil, ErrBadSignature
+	}
+	sent := time.Unix(0, ts)
+	if d := time.Since(sent); d > s.window() || d < -s.window() {
+		return nil, ErrStale
+	}
+	if err := s.checkOrigin(msg.From, pub, pk, from); err != nil {
+		return nil, err
+	}
+	if s.replayed(msg.Id) {
+		return nil, ErrReplay
+	}
+	return &msg, nil
+}
+
+func (s *signer) checkOrigin(node string, pub crypto.PubKey, pk []byte, from string) error {
+	id, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		return err
+	}
+	if id.String() == node {
+		return nil
+	}
+	if node != from {
+		return ErrOrigin
+	}
+	s.l.Lock()
+	defer s.l.Unlock()
+	if known, ok := s.keys[node]; ok && !bytes.Equal(known, pk) {
+		return ErrOrigin
+	}
+	s.keys[node] = pk
+	return nil
+}
+
+// replayed remembers id until it falls out of the window
+func (s *signer) replayed(id string) bool {
+	s.l.Lock()
+	defer s.l.Unlock()
+	now := time.Now()
+	if now.Sub(s.purged) > s.window() {
+		for nonce, t := range s.nonces {
+			if now.Sub(t) > 2*s.window() {
+				delete(s.nonces, nonce)
+			}
+		}
+		s.purged = now
+	}
+	if _, ok := s.nonces[id]; ok {
+		return true
+	}
+	s.nonces[id] = now
+	return false
+}
+
+// parseFields calls field for every varint and bytes field, others are skipped
+func parseFields(b []byte, field func(num protowire.Number, typ protowire.Type, v []byte, n uint64)) error {
+	for len(b) > 0 {
+		num, typ, l := protowire.ConsumeTag(b)
+		if l < 0 {
+			return protowire.ParseError(l)
+		}
+		b = b[l:]
+		switch typ {
+		case protowire.VarintType:
+			n, l := protowire.ConsumeVarint(b)
+			if l < 0 {
+				return protowire.ParseError(l)
+			}
+			field(num, typ, nil, n)
+			b = b[l:]
+		case protowire.BytesType:
+			v, l := protowire.ConsumeBytes(b)
+			if l < 0 {
+				return protowire.ParseError(l)
+			}
+			field(num, typ, v, 0)
+			b = b[l:]
+		default:
+			l := protowire.ConsumeFieldValue(num, typ, b)
+			if l < 0 {
+				return protowire.ParseError(l)
+			}
+			b = b[l:]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package network
+
+import (
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/config"
+	"sort"
+	"sync/atomic"
+)
+
+/*
+ * A node takes part in one or more federations. The name of a federation
+ * derives its pubsub topics, tipfs/<name>, or tipfs/<name>/<kind> if it
+ * splits its traffic by kind. The federation without a name uses the
+ * TEZOS_IPFS topic all tipfs nodes shared before. Received messages carry
+ * the name of their federation in Network.
+ */
+
+type federation struct {
+	name     string
+	perKind  bool
+	sent     uint64
+	received uint64
+}
+
+type FederationStats struct {
+	Name     string
+	Topics   []string
+	Sent     uint64
+	Received uint64
+}
+
+// TopicName is the topic of network name, kind is empty for the topic of all kinds
+func TopicName(name string, kind string) string {
+	base := BROADCAST_TOPIC
+	if name != "" {
+		base = "tipfs/" + name
+	}
+	if kind != "" {
+		return base + "/" + kind
+	}
+	return base
+}
+
+func newFederations(c *config.Config) []*federation {
+	res := []*federation{}
+	for _, f := range c.Federations() {
+		res = append(res, &federation{name: f.Name, perKind: f.TopicPerKind})
+	}
+	return res
+}
+
+// kinds are the kinds with a topic of their own
+func kinds() []string {
+	res := []string{}
+	for kind := range schemas {
+		res = append(res, kind)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// topics maps the topics of f to the kind they carry, "" for all kinds
+func (f *federation) topics() map[string]string {
+	if !f.perKind {
+		return map[string]string{TopicName(f.name, ""): ""}
+	}
+	res := map[string]string{}
+	for _, kind := range kinds() {
+		res[TopicName(f.name, kind)] = kind
+	}
+	return res
+}
+
+func (f *federation) topicOf(kind string) string {
+	if !f.perKind {
+		return TopicName(f.name, "")
+	}
+	return TopicName(f.name, kind)
+}
+
+// targets are the federations msg goes to, all of them unless to is one of them
+func targets(feds []*federation, to *string) []*federation {
+	if to == nil {
+		return feds
+	}
+	for _, f := range feds {
+		if f.name == *to {
+			return []*federation{f}
+		}
+	}
+	return []*federation{}
+}
+
+func federationStats(feds []*federation) []FederationStats {
+	res := []FederationStats{}
+	for _, f := range feds {
+		topics := []string{}
+		for t := range f.topics() {
+			topics = append(topics, t)
+		}
+		sort.Strings(topics)
+		res = append(res, FederationStats{
+			Name:     f.name,
+			Topics:   topics,
+			Sent:     atomic.LoadUint64(&f.sent),
+			Received: atomic.LoadUint64(&f.received),
+		})
+	}
+	return res
+}
@@ -3,43 +3,73 @@ package network
 import (
 	"archive/tar"
 	"context"
-	"encoding/json"
-	"github.com/google/uuid"
-	lru "github.com/hashicorp/golang-lru"
+	"github.com/ipfs/go-cid"
 	shell "github.com/ipfs/go-ipfs-api"
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	"github.com/sirupsen/logrus"
 	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/config"
 	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type IPFS struct {
 	sh               *shell.Shell
 	log              *logrus.Entry
 	connected        map[string]bool
-	pubsubscriptions []chan *PubSubMessage
+	bus              *Bus
 	id               string
-	msgcache         *lru.Cache
+	signer           *signer
+	guard            *guard
+	feds             []*federation
+	wanted           []string
+	l                *sync.Mutex
 }
 
-func NewIPFS(c *config.Config, l *logrus.Entry) *IPFS {
+func NewIPFS(c *config.Config, privkey []byte, l *logrus.Entry) *IPFS {
 	url := c.GetIpfsAPI()
 	if url == nil {
 		return nil
 	}
 	r := IPFS{}
 	r.connected = map[string]bool{}
-	r.pubsubscriptions = []chan *PubSubMessage{}
+	r.l = &sync.Mutex{}
 	r.log = l.WithField("source", "ipfs-wrapper")
+	r.bus = NewBus(r.log)
 	r.log.Info("Connecting to external IPFS Node....")
 	sh := shell.NewShell(*url)
 	if sh == nil {
 		r.log.Fatal("Can not connect to IPFS via " + *url)
 	}
 	r.sh = sh
-	r.msgcache, _ = lru.New(1500)
+	signer, err := newSigner(c, privkey)
+	if err != nil {
+		r.log.Fatal("Invalid private key: ", err)
+	}
+	r.signer = signer
 	pi, _ := r.sh.ID()
 	r.id = pi.ID
-	go r.listenPubSub()
+	self, _ := peer.Decode(r.id)
+	r.guard = newGuard(c, r.log, signer, self, r.isWanted)
+	r.feds = newFederations(c)
+	if c.Network.SwarmKey != "" {
+		if err := r.checkPrivate(c); err != nil {
+			r.log.Fatal("Refusing to use the IPFS node at "+*url+": ", err)
+		}
+	}
+	for _, f := range r.feds {
+		for t, kind := range f.topics() {
+			r.guard.topics[t] = kind
+		}
+	}
+	for _, f := range r.feds {
+		for t := range f.topics() {
+			go r.listenPubSub(t, f)
+		}
+	}
 	return &r
 }
 
@@ -77,6 +107,9 @@ func (i *IPFS) GetFile(ctx context.Context, cidStr string) (io.Reader, error) {
 
 func (i *IPFS) Connect(peers []string) error {
 	ctx := context.Background()
+	i.l.Lock()
+	i.wanted = peers
+	i.l.Unlock()
 	for _, a := range peers {
 		if a == i.id {
 			continue
@@ -102,39 +135,73 @@ func (i *IPFS) Connect(peers []string) error {
 	return nil
 }
 
+// SendMessage sends msg to all our federations
 func (i *IPFS) SendMessage(msg *PubSubMessage) {
-	msg.Id = uuid.New().String()
-	data, _ := json.Marshal(msg)
-	i.sh.PubSubPublish(BROADCAST_TOPIC, string(data))
+	i.publish(msg, nil)
 }
 
-func (i *IPFS) listenPubSub() {
-	s, e := i.sh.PubSubSubscribe(BROADCAST_TOPIC)
+// SendMessageTo sends msg to the federation network only
+func (i *IPFS) SendMessageTo(network string, msg *PubSubMessage) {
+	i.publish(msg, &network)
+}
+
+func (i *IPFS) publish(msg *PubSubMessage, to *string) {
+	for _, f := range targets(i.feds, to) {
+		data, err := i.signer.seal(msg, i.id)
+		if err != nil {
+			i.log.Error("Could not sign message: ", err)
+			return
+		}
+		if err := i.sh.PubSubPublish(f.topicOf(msg.Kind), string(data)); err != nil {
+			i.log.WithField("federation", f.name).Warn("Could not publish: ", err)
+			continue
+		}
+		atomic.AddUint64(&f.sent, 1)
+	}
+}
+
+func (i *IPFS) Federations() []FederationStats {
+	return federationStats(i.feds)
+}
+
+// listenPubSub subscribes again with a backoff if the subscription dies, e.g. when the node restarts
+func (i *IPFS) listenPubSub(topic string, f *federation) {
+	s, e := i.sh.PubSubSubscribe(topic)
 	if e != nil {
 		i.log.Fatal(e)
 	}
+	wait := time.Second
 	for {
 		var msg, e = s.Next()
 		if e != nil {
-			i.log.Warn(e)
-		}
-		psmg := PubSubMessage{}
-		json.Unmarshal(msg.Data, &psmg)
-		if _, ok := i.msgcache.Get(psmg.Id); !ok {
-			i.msgcache.Add(psmg.Id, true)
-			psmg.From = msg.From.String()
-			for _, c := range i.pubsubscriptions {
-				c <- &psmg
+			i.log.WithField("topic", topic).Warn("Subscription failed, subscribing again in ", wait, ": ", e)
+			s.Cancel()
+			time.Sleep(wait)
+			if wait < time.Minute {
+				wait *= 2
 			}
-
+			if n, err := i.sh.PubSubSubscribe(topic); err == nil {
+				s = n
+			}
+			continue
+		}
+		wait = time.Second
+		// the node relays what it gets, we can only drop it
+		psmg, res := i.guard.check(msg.From, msg.Data)
+		if res != pubsub.ValidationAccept {
+			continue
+		}
+		if kind := i.guard.topics[topic]; kind != "" && kind != psmg.Kind {
+			continue
 		}
+		psmg.Network = f.name
+		atomic.AddUint64(&f.received, 1)
+		i.bus.Publish(psmg)
 	}
 }
 
-func (i *IPFS) Subscribe() chan *PubSubMessage {
-	res := make(chan *PubSubMessage, 10)
-	i.pubsubscriptions = append(i.pubsubscriptions, res)
-	return res
+func (i *IPFS) Events() *Bus {
+	return i.bus
 }
 
 func (i *IPFS) UploadAndPin(file io.Reader) (string, error) {
@@ -143,19 +210,95 @@ func (i *IPFS) UploadAndPin(file io.Reader) (string, error) {
 		return cid, err
 	}
 	err = i.sh.Pin(cid)
-	pinRequest := PubSubMessage{
-		Data: []byte(cid),
-		Kind: "new_object",
-	}
-	i.SendMessage(&pinRequest)
-	i.log.WithField("cid", cid).Trace("sending pin request")
 	return cid, err
 }
 
+func (i *IPFS) Import(file io.Reader) (string, error) {
+	return i.sh.Add(file, shell.Pin(false))
+}
+
 func (i *IPFS) ID() string {
 	return i.id
 }
 
+func (i *IPFS) Addrs() []string {
+	pi, err := i.sh.ID()
+	if err != nil {
+		i.log.Warn("Can not get addresses: ", err)
+		return []string{}
+	}
+	return pi.Addresses
+}
+
+func (i *IPFS) ConnectAddrs(addrs []string) error {
+	var lastErr error
+	for _, a := range addrs {
+		if err := i.sh.SwarmConnect(context.Background(), a); err != nil {
+			i.log.WithField("addr", a).Trace("can not connect: ", err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// GetBlock returns the raw block, offline only looks at what the node stores
+func (i *IPFS) GetBlock(ctx context.Context, cidStr string, offline bool) ([]byte, error) {
+	resp, err := i.sh.Request("block/get", cidStr).Option("offline", offline).Send(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Close()
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	return ioutil.ReadAll(resp.Output)
+}
+
+func (i *IPFS) Links(ctx context.Context, cidStr string) ([]string, error) {
+	c, err := cid.Decode(cidStr)
+	if err != nil {
+		return nil, err
+	}
+	if c.Type() == cid.Raw {
+		return []string{}, nil
+	}
+	obj, err := i.sh.ObjectGet(cidStr)
+	if err != nil {
+		return nil, err
+	}
+	res := []string{}
+	for _, link := range obj.Links {
+		res = append(res, link.Hash)
+	}
+	return res, nil
+}
+
+// GC runs the garbage collector of the node, removing everything not pinned
+func (i *IPFS) GC(ctx context.Context) error {
+	resp, err := i.sh.Request("repo/gc").Send(ctx)
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+	if resp.Error != nil {
+		return resp.Error
+	}
+	return nil
+}
+
+func (i *IPFS) ListPins(ctx context.Context) ([]string, error) {
+	var raw struct{ Keys map[string]shell.PinInfo }
+	err := i.sh.Request("pin/ls").Option("type", shell.RecursivePin).Exec(ctx, &raw)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0, len(raw.Keys))
+	for c := range raw.Keys {
+		res = append(res, c)
+	}
+	return res, nil
+}
+
 func (i *IPFS) LocalPin(cid string) error {
 	err := i.sh.Pin(cid)
 	if err != nil {
@@ -171,3 +314,55 @@ func (i *IPFS) LocalPin(cid string) error {
 func (i *IPFS) RemovePin(cid string) error {
 	return i.sh.Unpin(cid)
 }
+
+// isWanted is true for peers we connect to, the guard never bans them
+func (i *IPFS) isWanted(p peer.ID) bool {
+	i.l.Lock()
+	defer i.l.Unlock()
+	for _, id := range i.wanted {
+		if id == p.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// Peers reports the peers we connect to, discovery is done by the node itself
+func (i *IPFS) Peers() []PeerInfo {
+	i.l.Lock()
+	wanted := i.wanted
+	i.l.Unlock()
+	addrs := map[string][]string{}
+	if peers, err := i.sh.SwarmPeers(context.Background()); err == nil {
+		for _, p := range peers.Peers {
+			addrs[p.Peer] = append(addrs[p.Peer], p.Addr)
+		}
+	}
+	res := []PeerInfo{}
+	for _, id := range wanted {
+		if id == i.id {
+			continue
+		}
+		info := PeerInfo{
+			ID:     id,
+			Addrs:  []string{},
+			Wanted: true,
+			Source: SOURCE_IPFS,
+		}
+		if a, ok := addrs[id]; ok {
+			info.Addrs = a
+			info.Connected = true
+		}
+		res = append(res, info)
+	}
+	return res
+}
+
+// OpenStream is not supported, the api of an external node has no direct streams
+func (i *IPFS) OpenStream(ctx context.Context, peer string, protocol string) (io.ReadWriteCloser, error) {
+	return nil, ErrNotSupported
+}
+
+func (i *IPFS) SetStreamHandler(protocol string, handler StreamHandler) {
+	i.log.WithField("protocol", protocol).Trace("direct streams need the embedded node, using pubsub only")
+}
@@ -0,0 +1,117 @@
+package network
+
+import (
+	ipfslite "github.com/hsanjuan/ipfs-lite"
+	"github.com/libp2p/go-libp2p"
+	connmgr "github.com/libp2p/go-libp2p-connmgr"
+	"github.com/libp2p/go-libp2p-core/peer"
+	libp2pquic "github.com/libp2p/go-libp2p-quic-transport"
+	"github.com/multiformats/go-multiaddr"
+	"time"
+)
+
+/*
+ * Settings of the embedded node from the Network section. The defaults
+ * match what a single instance used before, running more than one
+ * instance per host only needs a different Datastore and Listen ports.
+ */
+
+const DEFAULT_DATASTORE = "/tmp/badger"
+
+var defaultListenAddrs = []string{
+	"/ip4/0.0.0.0/tcp/4005",
+	"/ip4/0.0.0.0/udp/4005/quic",
+}
+
+func (l *Lightclient) datastorePath() string {
+	if l.c.Network.Datastore != "" {
+		return l.c.Network.Datastore
+	}
+	return DEFAULT_DATASTORE
+}
+
+func (l *Lightclient) listenAddrs() ([]multiaddr.Multiaddr, error) {
+	addrs := l.c.Network.Listen
+	if len(addrs) == 0 {
+		addrs = defaultListenAddrs
+	}
+	res, err := parseMultiaddrs(addrs)
+	if err != nil || !l.private() {
+		return res, err
+	}
+	res, dropped := withoutQUIC(res)
+	if dropped {
+		l.log.Warn("QUIC does not support private networks, not listening on QUIC addresses")
+	}
+	return res, nil
+}
+
+func (l *Lightclient) connManager() *connmgr.BasicConnMgr {
+	low, high := l.c.Network.ConnManager.Low, l.c.Network.ConnManager.High
+	if low <= 0 {
+		low = 20
+	}
+	if high <= low {
+		high = low + 30
+	}
+	grace := time.Duration(l.c.Network.ConnManager.GracePeriod) * time.Second
+	if grace <= 0 {
+		grace = time.Minute
+	}
+	return connmgr.NewConnManager(low, high, grace)
+}
+
+// options of the libp2p host, offline and private nodes skip NAT traversal and relays
+func (l *Lightclient) options(cm *connmgr.BasicConnMgr) ([]libp2p.Option, error) {
+	opts := []libp2p.Option{
+		libp2p.ConnectionManager(cm),
+		libp2p.DefaultTransports,
+	}
+	if !l.private() {
+		opts = append(opts, libp2p.Transport(libp2pquic.NewTransport))
+	}
+	if !l.c.Network.Offline && !l.private() {
+		opts = append(opts,
+			libp2p.NATPortMap(),
+			libp2p.EnableAutoRelay(),
+			libp2p.EnableNATService(),
+		)
+	}
+	if len(l.c.Network.Announce) > 0 {
+		announce, err := parseMultiaddrs(l.c.Network.Announce)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, libp2p.AddrsFactory(func([]multiaddr.Multiaddr) []multiaddr.Multiaddr {
+			return announce
+		}))
+	}
+	return opts, nil
+}
+
+// bootstrapPeers are the configured ones, or the public ipfs peers unless we are offline or private
+func (l *Lightclient) bootstrapPeers() ([]peer.AddrInfo, error) {
+	if len(l.c.Network.Bootstrap) == 0 {
+		if l.c.Network.Offline || l.private() {
+			return []peer.AddrInfo{}, nil
+		}
+		return ipfslite.DefaultBootstrapPeers(), nil
+	}
+	addrs, err := parseMultiaddrs(l.c.Network.Bootstrap)
+	if err != nil {
+		return nil, err
+	}
+	return peer.AddrInfosFromP2pAddrs(addrs...)
+}
+
+func parseMultiaddrs(addrs []string) ([]multiaddr.Multiaddr, error) {
+	res := []multiaddr.Multiaddr{}
+	for _, a := range addrs {
+		ma, err := multiaddr.NewMultiaddr(a)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, ma)
+	}
+	return res, nil
+}
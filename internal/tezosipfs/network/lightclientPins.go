@@ -0,0 +1,193 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-merkledag"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/pinset"
+	"time"
+)
+
+/*
+ * The embedded node keeps its pinset next to the blocks in the datastore,
+ * see pinset.Pinset. Recursive pins protect the whole DAG, direct pins
+ * only the root block. GC is a mark-and-sweep over the blockstore:
+ * everything reachable from a pin is kept, the rest is deleted. Blocks
+ * missing from a pinned DAG are logged and skipped, the blocks we can
+ * reach are still kept. Uploads hold the read lock of gcLock while they
+ * add, pins only while they check the fetched DAG and record the pin,
+ * so the sweep never removes blocks of a pin that is not recorded yet.
+ */
+
+var ErrStorageFull = errors.New("storage limit of the embedded node reached")
+
+var errCollected = errors.New("blocks were collected while pinning")
+
+// LocalPin fetches the whole DAG of cid and pins it recursively
+func (l *Lightclient) LocalPin(cidStr string) error {
+	c, err := cid.Decode(cidStr)
+	if err != nil {
+		return err
+	}
+	if err := l.checkStorage(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	for tries := 0; tries < 3; tries++ {
+		// without the lock, a waiting gc would hold up every upload until the fetch is done
+		if err := merkledag.FetchGraph(ctx, c, l.client); err != nil {
+			return err
+		}
+		if l.pinFetched(ctx, c) {
+			return nil
+		}
+	}
+	return errCollected
+}
+
+// pinFetched records the pin if no gc removed blocks since the fetch
+func (l *Lightclient) pinFetched(ctx context.Context, c cid.Cid) bool {
+	l.gcLock.RLock()
+	defer l.gcLock.RUnlock()
+	if err := pinset.Complete(ctx, l.client.BlockStore(), c); err != nil {
+		return false
+	}
+	if err := l.pinset.Add(pinset.RECURSIVE, c); err != nil {
+		l.log.WithField("cid", c.String()).Error("Could not record pin: ", err)
+		return false
+	}
+	return true
+}
+
+// RemovePin drops both kinds of pins of the content, the blocks stay until the next GC
+func (l *Lightclient) RemovePin(cidStr string) error {
+	c, err := cid.Decode(cidStr)
+	if err != nil {
+		return err
+	}
+	return l.pinset.Remove(c)
+}
+
+// ListPins returns the recursive pins, like the ipfs backend
+func (l *Lightclient) ListPins(ctx context.Context) ([]string, error) {
+	pins, err := l.pinset.List(pinset.RECURSIVE)
+	if err != nil {
+		return nil, err
+	}
+	res := []string{}
+	for _, c := range pins {
+		res = append(res, c.String())
+	}
+	return res, nil
+}
+
+// GC deletes every block that is not reachable from a pin
+func (l *Lightclient) GC(ctx context.Context) error {
+	l.gcLock.Lock()
+	defer l.gcLock.Unlock()
+	start := time.Now()
+
+	bs := l.client.BlockStore()
+	keep, incomplete, err := l.pinset.Mark(ctx, bs)
+	if err != nil {
+		return errors.New("gc aborted, could not walk pins: " + err.Error())
+	}
+	for c, missing := range incomplete {
+		l.log.WithField("cid", c).WithField("missing", missing).Warn("Pinned DAG is incomplete, keeping the blocks we have")
+	}
+	keys, err := bs.AllKeysChan(ctx)
+	if err != nil {
+		return err
+	}
+	removed := 0
+	var freed int64
+	for c := range keys {
+		if keep[string(c.Hash())] {
+			continue
+		}
+		size, _ := bs.GetSize(c)
+		if err := bs.DeleteBlock(c); err != nil {
+			l.log.WithField("cid", c.String()).Warn("Could not delete block: ", err)
+			continue
+		}
+		removed++
+		freed += int64(size)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// badger only gives space back once its value log is collected
+	if gc, ok := l.ds.(interface{ CollectGarbage() error }); ok {
+		if err := gc.CollectGarbage(); err != nil {
+			l.log.Warn("Datastore garbage collection failed: ", err)
+		}
+	}
+	l.log.WithField("kept", len(keep)).
+		WithField("removed", removed).
+		WithField("freed", freed).
+		WithField("duration", time.Since(start)).Info("Garbage collection completed")
+	return nil
+}
+
+// DiskUsage is the size of the datastore in bytes
+func (l *Lightclient) DiskUsage() (uint64, error) {
+	return datastore.DiskUsage(l.ds)
+}
+
+func (l *Lightclient) maxStorage() uint64 {
+	return uint64(l.c.Network.MaxStorage) * 1024 * 1024
+}
+
+// checkStorage runs a GC if we are over the limit and fails if that did not help
+func (l *Lightclient) checkStorage() error {
+	max := l.maxStorage()
+	if max == 0 {
+		return nil
+	}
+	usage, err := l.DiskUsage()
+	if err != nil || usage < max {
+		return nil
+	}
+	l.log.WithField("usage", usage).Warn("Storage limit reached, collecting garbage")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	if err := l.GC(ctx); err != nil {
+		l.log.Error("Garbage collection failed: ", err)
+	}
+	if usage, err = l.DiskUsage(); err == nil && usage >= max {
+		return ErrStorageFull
+	}
+	return nil
+}
+
+// gcLoop collects garbage whenever usage crosses the watermark
+func (l *Lightclient) gcLoop() {
+	for {
+		interval := time.Duration(l.c.Network.GCInterval) * time.Minute
+		if interval <= 0 {
+			interval = time.Hour
+		}
+		time.Sleep(interval)
+		watermark := l.c.Network.GCWatermark
+		if watermark <= 0 || watermark > 100 {
+			watermark = 90
+		}
+		usage, err := l.DiskUsage()
+		if err != nil {
+			l.log.Warn("Could not determine disk usage: ", err)
+			continue
+		}
+		if usage*100 < l.maxStorage()*uint64(watermark) {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+		if err := l.GC(ctx); err != nil {
+			l.log.Error("Garbage collection failed: ", err)
+		}
+		cancel()
+	}
+}
@@ -2,18 +2,47 @@ package network
 
 import (
 	"context"
+	"errors"
 	"io"
 )
 
+var ErrNotSupported = errors.New("not supported by this backend")
+
 type NetworkInterface interface {
 	 GetFile(ctx context.Context, cidStr string) (io.Reader,error)
 	 Connect(peers []string) error
-	 SendMessage(msg *PubSubMessage)
-	 Subscribe() chan *PubSubMessage
-	 UploadAndPin(file io.Reader) (string,error)
+	 SendMessage(msg *PubSubMessage) // to all our federations
+	 SendMessageTo(network string, msg *PubSubMessage)
+	 Federations() []FederationStats
+	 Events() *Bus // received messages, by Kind
+	 UploadAndPin(file io.Reader) (string,error) // announcing is up to the caller
+	 Import(file io.Reader) (string, error) // adds without pinning
      LocalPin(cid string) error
 	 RemovePin(cid string) error
 	 ID() string
+	 Addrs() []string
+	 ConnectAddrs(addrs []string) error
+	 GetBlock(ctx context.Context, cidStr string, offline bool) ([]byte, error)
+	 Links(ctx context.Context, cidStr string) ([]string, error)
+	 GC(ctx context.Context) error
+	 ListPins(ctx context.Context) ([]string, error) // recursive pins
+	 Peers() []PeerInfo // the peers we were asked to connect to and discovered ones
+	 OpenStream(ctx context.Context, peer string, protocol string) (io.ReadWriteCloser, error)
+	 SetStreamHandler(protocol string, handler StreamHandler)
+}
+
+// StreamHandler serves a direct stream opened by peer from
+type StreamHandler func(from string, s io.ReadWriteCloser)
+
+type PeerInfo struct {
+	ID        string
+	Addrs     []string
+	Connected bool
+	Protected bool   // never trimmed by the connection manager
+	Wanted    bool   // passed to Connect, i.e. from the Peers config
+	Source    string // how we found it: dht, mdns or ipfs for an external node
+	Banned    bool    // sent too many invalid messages
+	Score     float64 // gossipsub score, only known to the light client
 }
 
 type PubSubMessage struct {
@@ -21,4 +50,5 @@ type PubSubMessage struct {
 	Data []byte
 	Kind string
 	From string
+	Network string // the federation we received it in
 }
\ No newline at end of file
@@ -0,0 +1,140 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	ipfslite "github.com/hsanjuan/ipfs-lite"
+	"github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/pnet"
+	"github.com/libp2p/go-libp2p-core/routing"
+	dht2 "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/config"
+	"os"
+	"strings"
+)
+
+/*
+ * Private swarms: with Network.SwarmKey set, the embedded node only talks
+ * to peers that have the same swarm.key. It never dials the public
+ * bootstrap peers, QUIC is off since it can not do private networks, and
+ * the DHT uses its own protocol, so it can not mix with the public one.
+ */
+
+const PRIVATE_DHT_PREFIX = "/tezos-ipfs"
+
+var ErrPublicNode = errors.New("a swarm key is configured, but the IPFS node is part of the public network")
+var ErrSwarmKeyMismatch = errors.New("the swarm key of the IPFS node differs from Network.SwarmKey")
+
+func (l *Lightclient) private() bool {
+	return l.c.Network.SwarmKey != ""
+}
+
+// loadSwarmKey reads a swarm.key in the /key/swarm/psk/1.0.0/ format
+func loadSwarmKey(path string) (pnet.PSK, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return pnet.DecodeV1PSK(f)
+}
+
+// setupPrivate creates a host that only connects to peers with our psk
+func (l *Lightclient) setupPrivate(ctx context.Context, priv crypto.PrivKey, psk pnet.PSK, listen []multiaddr.Multiaddr, ds datastore.Batching, opts []libp2p.Option) (host.Host, *dht2.IpfsDHT, error) {
+	var dht *dht2.IpfsDHT
+	opts = append([]libp2p.Option{
+		libp2p.Identity(priv),
+		libp2p.ListenAddrs(listen...),
+		libp2p.PrivateNetwork(psk),
+		libp2p.Routing(func(h host.Host) (routing.PeerRouting, error) {
+			var err error
+			dht, err = dht2.New(ctx, h,
+				dht2.Datastore(ds),
+				dht2.Mode(dht2.ModeServer),
+				dht2.ProtocolPrefix(PRIVATE_DHT_PREFIX),
+			)
+			return dht, err
+		}),
+	}, opts...)
+	h, err := libp2p.New(ctx, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return h, dht, nil
+}
+
+// withoutQUIC drops quic addresses, they would fail in a private network
+func withoutQUIC(addrs []multiaddr.Multiaddr) ([]multiaddr.Multiaddr, bool) {
+	res := []multiaddr.Multiaddr{}
+	for _, a := range addrs {
+		if _, err := a.ValueForProtocol(multiaddr.P_QUIC); err == nil {
+			continue
+		}
+		res = append(res, a)
+	}
+	return res, len(res) != len(addrs)
+}
+
+/*
+ * checkPrivate makes sure an external node is not part of the public network.
+ * The api does not expose the swarm key, so it is compared only if we can
+ * read the key of the node from Gateway.Backend.IPFS.SwarmKey. Otherwise
+ * we can just look for the public bootstrap peers in its config and among
+ * its connections, which is best-effort.
+ */
+func (i *IPFS) checkPrivate(c *config.Config) error {
+	if path := c.Gateway.Backend.IPFS.SwarmKey; path != "" {
+		ours, err := loadSwarmKey(c.Network.SwarmKey)
+		if err != nil {
+			return err
+		}
+		theirs, err := loadSwarmKey(path)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(ours, theirs) {
+			return ErrSwarmKeyMismatch
+		}
+		return nil
+	}
+	i.log.Warn("Can not verify the swarm key of the IPFS node, only checking for public peers")
+	public := map[string]bool{}
+	for _, p := range defaultBootstrapIDs() {
+		public[p] = true
+	}
+	res := struct {
+		Value []string
+	}{}
+	err := i.sh.Request("config", "Bootstrap").Exec(context.Background(), &res)
+	if err != nil {
+		return err
+	}
+	for _, a := range res.Value {
+		if public[a[strings.LastIndex(a, "/")+1:]] {
+			return ErrPublicNode
+		}
+	}
+	peers, err := i.sh.SwarmPeers(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, p := range peers.Peers {
+		if public[p.Peer] {
+			return ErrPublicNode
+		}
+	}
+	return nil
+}
+
+func defaultBootstrapIDs() []string {
+	res := []string{}
+	for _, p := range ipfslite.DefaultBootstrapPeers() {
+		res = append(res, p.ID.String())
+	}
+	return res
+}
@@ -0,0 +1,319 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/multiformats/go-multihash"
+	"github.com/sirupsen/logrus"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/config"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Anyone can publish on the broadcast topic. Before a message is delivered
+ * or forwarded, the guard checks its size, the rate of its sender, the
+ * envelope, the kind and the schema of the kind. Invalid messages are
+ * rejected, which also lowers the gossipsub score of the peers relaying
+ * them, senders that keep sending them are banned for a while. Messages
+ * over the rate limit, of unknown kinds (newer nodes) or outside of the
+ * timestamp window are ignored without penalty.
+ */
+
+const (
+	DEFAULT_MAX_MESSAGE_SIZE = 1024 // KB
+	DEFAULT_RATE             = 10
+	DEFAULT_BURST            = 100
+	DEFAULT_BAN_AFTER        = 20
+	DEFAULT_BAN_TIME         = 60 // minutes
+)
+
+// schemas of the kinds we know, a message of another kind is ignored
+var schemas = map[string]func(data []byte) bool{
+	"peer_advertisement": isJSONObject,
+	"new_object":         isPinRequest,
+	"pin_rejected":       isJSONObject,
+	"pinned":             isCid,
+	"cached":             isCid,
+	"hot_cids":           json.Valid,
+	"storage_challenge":  isJSONObject,
+	"storage_proof":      isJSONObject,
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type guard struct {
+	c       *config.Config
+	log     *logrus.Entry
+	signer  *signer
+	self    peer.ID
+	exempt  func(peer.ID) bool // never banned, e.g. peers of our config
+	ban     func(peer.ID)      // tells the transport, nil if it can not ban
+	l       *sync.Mutex
+	buckets map[peer.ID]*bucket
+	strikes map[peer.ID]int
+	banned  map[peer.ID]time.Time
+	scores  map[peer.ID]float64
+	purged  time.Time
+	topics  map[string]string // our topics and the kind they carry, "" for all kinds
+}
+
+func newGuard(c *config.Config, log *logrus.Entry, s *signer, self peer.ID, exempt func(peer.ID) bool) *guard {
+	return &guard{
+		c:       c,
+		log:     log,
+		signer:  s,
+		self:    self,
+		exempt:  exempt,
+		l:       &sync.Mutex{},
+		buckets: map[peer.ID]*bucket{},
+		strikes: map[peer.ID]int{},
+		banned:  map[peer.ID]time.Time{},
+		scores:  map[peer.ID]float64{},
+		purged:  time.Now(),
+		topics:  map[string]string{},
+	}
+}
+
+func (g *guard) maxSize() int {
+	if g.c.Network.Pubsub.MaxMessageSize > 0 {
+		return g.c.Network.Pubsub.MaxMessageSize * 1024
+	}
+	return DEFAULT_MAX_MESSAGE_SIZE * 1024
+}
+
+func (g *guard) rate() float64 {
+	if g.c.Network.Pubsub.Rate > 0 {
+		return g.c.Network.Pubsub.Rate
+	}
+	return DEFAULT_RATE
+}
+
+func (g *guard) burst() float64 {
+	if g.c.Network.Pubsub.Burst > 0 {
+		return float64(g.c.Network.Pubsub.Burst)
+	}
+	return DEFAULT_BURST
+}
+
+func (g *guard) banAfter() int {
+	if g.c.Network.Pubsub.BanAfter != 0 {
+		return g.c.Network.Pubsub.BanAfter
+	}
+	return DEFAULT_BAN_AFTER
+}
+
+func (g *guard) banTime() time.Duration {
+	if g.c.Network.Pubsub.BanTime > 0 {
+		return time.Duration(g.c.Network.Pubsub.BanTime) * time.Minute
+	}
+	return DEFAULT_BAN_TIME * time.Minute
+}
+
+// validate is the topic validator of the light client, accepted messages carry the opened one
+func (g *guard) validate(ctx context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+	m, res := g.check(msg.GetFrom(), msg.Data)
+	if res != pubsub.ValidationAccept {
+		return res
+	}
+	if kind := g.topics[msg.GetTopic()]; kind != "" && kind != m.Kind {
+		g.strike(msg.GetFrom(), m.Kind+" on the topic of "+kind)
+		return pubsub.ValidationReject
+	}
+	msg.ValidatorData = m
+	return res
+}
+
+// check decides about data published by author, it returns the message if it is accepted
+func (g *guard) check(author peer.ID, data []byte) (*PubSubMessage, pubsub.ValidationResult) {
+	if author != g.self {
+		if g.Banned(author) {
+			return nil, pubsub.ValidationReject
+		}
+		if len(data) > g.maxSize() {
+			g.strike(author, "message too large")
+			return nil, pubsub.ValidationReject
+		}
+		if !g.allow(author) {
+			g.log.WithField("peer", author.String()).Trace("rate limit exceeded, ignoring message")
+			return nil, pubsub.ValidationIgnore
+		}
+	}
+	msg, err := g.signer.open(data, author.String())
+	switch err {
+	case nil:
+	case ErrReplay:
+		// we get most messages more than once
+		return nil, pubsub.ValidationIgnore
+	case ErrUnknownVersion, ErrUnsigned, ErrStale:
+		// other versions or a wrong clock, not an attack
+		g.log.WithField("peer", author.String()).Debug("ignoring message: ", err)
+		return nil, pubsub.ValidationIgnore
+	default:
+		g.strike(author, err.Error())
+		return nil, pubsub.ValidationReject
+	}
+	schema, ok := schemas[msg.Kind]
+	if !ok {
+		g.log.WithField("peer", author.String()).WithField("kind", msg.Kind).Debug("ignoring message of unknown kind")
+		return nil, pubsub.ValidationIgnore
+	}
+	if !schema(msg.Data) {
+		g.strike(author, "invalid "+msg.Kind)
+		return nil, pubsub.ValidationReject
+	}
+	return msg, pubsub.ValidationAccept
+}
+
+// allow takes a token from the bucket of p
+func (g *guard) allow(p peer.ID) bool {
+	g.l.Lock()
+	defer g.l.Unlock()
+	now := time.Now()
+	if now.Sub(g.purged) > 10*time.Minute {
+		for id, b := range g.buckets {
+			if now.Sub(b.last) > 10*time.Minute {
+				delete(g.buckets, id)
+			}
+		}
+		for id, until := range g.banned {
+			if now.After(until) {
+				delete(g.banned, id)
+			}
+		}
+		g.purged = now
+	}
+	b, ok := g.buckets[p]
+	if !ok {
+		b = &bucket{tokens: g.burst(), last: now}
+		g.buckets[p] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * g.rate()
+	if b.tokens > g.burst() {
+		b.tokens = g.burst()
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// strike counts an invalid message of p and bans it after too many
+func (g *guard) strike(p peer.ID, reason string) {
+	g.log.WithField("peer", p.String()).Warn("rejecting message: ", reason)
+	if g.banAfter() < 0 || (g.exempt != nil && g.exempt(p)) {
+		return
+	}
+	g.l.Lock()
+	g.strikes[p]++
+	if g.strikes[p] < g.banAfter() {
+		g.l.Unlock()
+		return
+	}
+	delete(g.strikes, p)
+	g.banned[p] = time.Now().Add(g.banTime())
+	g.l.Unlock()
+	g.log.WithField("peer", p.String()).Warn("banning peer for ", g.banTime(), " after too many invalid messages")
+	if g.ban != nil {
+		g.ban(p)
+	}
+}
+
+func (g *guard) Banned(p peer.ID) bool {
+	g.l.Lock()
+	defer g.l.Unlock()
+	until, ok := g.banned[p]
+	return ok && time.Now().Before(until)
+}
+
+// appScore sends banned peers below the graylist threshold
+func (g *guard) appScore(p peer.ID) float64 {
+	if g.Banned(p) {
+		return -10000
+	}
+	return 0
+}
+
+func (g *guard) inspect(scores map[peer.ID]float64) {
+	g.l.Lock()
+	defer g.l.Unlock()
+	g.scores = scores
+}
+
+func (g *guard) score(p peer.ID) float64 {
+	g.l.Lock()
+	defer g.l.Unlock()
+	return g.scores[p]
+}
+
+// options of gossipsub, an invalid message costs more the more of them a peer sends
+func (g *guard) options() ([]pubsub.Option, error) {
+	bans, err := pubsub.NewTimeCachedBlacklist(g.banTime())
+	if err != nil {
+		return nil, err
+	}
+	topics := map[string]*pubsub.TopicScoreParams{}
+	for t := range g.topics {
+		topics[t] = &pubsub.TopicScoreParams{
+			TopicWeight:                    1,
+			TimeInMeshQuantum:              time.Second,
+			InvalidMessageDeliveriesWeight: -10,
+			InvalidMessageDeliveriesDecay:  pubsub.ScoreParameterDecay(time.Hour),
+		}
+	}
+	params := &pubsub.PeerScoreParams{
+		Topics:            topics,
+		AppSpecificScore:  g.appScore,
+		AppSpecificWeight: 1,
+		DecayInterval:     pubsub.DefaultDecayInterval,
+		DecayToZero:       pubsub.DefaultDecayToZero,
+		RetainScore:       time.Hour,
+	}
+	thresholds := &pubsub.PeerScoreThresholds{
+		GossipThreshold:             -100,
+		PublishThreshold:            -500,
+		GraylistThreshold:           -1000,
+		AcceptPXThreshold:           10,
+		OpportunisticGraftThreshold: 5,
+	}
+	return []pubsub.Option{
+		pubsub.WithBlacklist(bans),
+		pubsub.WithPeerScore(params, thresholds),
+		pubsub.WithPeerScoreInspect(g.inspect, 10*time.Second),
+	}, nil
+}
+
+func isJSONObject(data []byte) bool {
+	return len(data) > 0 && data[0] == '{' && json.Valid(data)
+}
+
+// isCid also accepts the multihash keys we use in the db
+func isCid(data []byte) bool {
+	str := strings.TrimSpace(string(data))
+	if _, err := cid.Decode(str); err == nil {
+		return true
+	}
+	_, err := multihash.FromB58String(str)
+	return err == nil
+}
+
+// isPinRequest accepts a plain cid or a json pin request
+func isPinRequest(data []byte) bool {
+	if len(data) == 0 || data[0] != '{' {
+		return isCid(data)
+	}
+	req := struct{ Cid string }{}
+	if err := json.Unmarshal(data, &req); err != nil {
+		return false
+	}
+	return isCid([]byte(req.Cid))
+}
@@ -0,0 +1,286 @@
+package pinqueue
+
+import (
+	"encoding/json"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/common"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Priority int
+
+const (
+	Admin      Priority = iota // requested via the admin api
+	Trusted                    // announced by a peer in PinFor
+	Transitive                 // everything else: retries, resumes, re-announcements
+)
+
+var priorityNames = []string{"admin", "trusted", "transitive"}
+
+func (p Priority) String() string {
+	return priorityNames[p]
+}
+
+func (p Priority) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+type Job struct {
+	Cid      string
+	Key      string
+	From     string
+	Priority Priority
+	Queued   time.Time
+	Started  *time.Time `json:",omitempty"`
+	Expires  *time.Time `json:",omitempty"` // lease, nil is permanent
+	Request  bool       `json:"-"`          // asked for by someone, not a retry
+	Direct   bool       `json:"-"`          // only asked for over streams, acks go there
+}
+
+/*
+ * originQueue hands out jobs round-robin per origin,
+ * so one busy peer can not starve everybody else
+ */
+type originQueue struct {
+	origins []string
+	jobs    map[string][]*Job
+	next    int
+	size    int
+}
+
+func newOriginQueue() *originQueue {
+	return &originQueue{jobs: map[string][]*Job{}}
+}
+
+func (o *originQueue) push(j *Job) {
+	if _, ok := o.jobs[j.From]; !ok {
+		o.origins = append(o.origins, j.From)
+	}
+	o.jobs[j.From] = append(o.jobs[j.From], j)
+	o.size++
+}
+
+func (o *originQueue) pop() *Job {
+	if o.size == 0 {
+		return nil
+	}
+	if o.next >= len(o.origins) {
+		o.next = 0
+	}
+	origin := o.origins[o.next]
+	jobs := o.jobs[origin]
+	j := jobs[0]
+	if len(jobs) == 1 {
+		o.dropOrigin(o.next)
+	} else {
+		o.jobs[origin] = jobs[1:]
+		o.next++
+	}
+	o.size--
+	return j
+}
+
+func (o *originQueue) remove(j *Job) {
+	jobs := o.jobs[j.From]
+	for i, a := range jobs {
+		if a != j {
+			continue
+		}
+		o.size--
+		if len(jobs) == 1 {
+			for k, origin := range o.origins {
+				if origin == j.From {
+					o.dropOrigin(k)
+					break
+				}
+			}
+			return
+		}
+		o.jobs[j.From] = append(jobs[:i:i], jobs[i+1:]...)
+		return
+	}
+}
+
+func (o *originQueue) dropOrigin(i int) {
+	delete(o.jobs, o.origins[i])
+	o.origins = append(o.origins[:i:i], o.origins[i+1:]...)
+	if o.next > i {
+		o.next--
+	}
+}
+
+type Stats struct {
+	Workers   int
+	Running   int
+	Queued    map[string]int // per priority
+	PerOrigin map[string]int
+	Enqueued  uint64
+	Completed uint64
+	Dropped   uint64 // queue was full
+	MaxQueued int    // per origin
+}
+
+/*
+ * Queue is a priority queue with per-origin fairness,
+ * jobs are deduplicated by key while queued or running
+ */
+type Queue struct {
+	l         *sync.Mutex
+	cond      *sync.Cond
+	classes   []*originQueue
+	queued    map[string]*Job
+	running   map[string]*Job
+	perOrigin map[string]int // queued jobs
+	maxQueued int            // per origin
+	workers   int
+	enqueued  uint64
+	completed uint64
+	dropped   uint64
+}
+
+func New(workers int, maxQueued int) *Queue {
+	q := &Queue{
+		l:         &sync.Mutex{},
+		queued:    map[string]*Job{},
+		running:   map[string]*Job{},
+		perOrigin: map[string]int{},
+		maxQueued: maxQueued,
+		workers:   workers,
+	}
+	q.cond = sync.NewCond(q.l)
+	for range priorityNames {
+		q.classes = append(q.classes, newOriginQueue())
+	}
+	return q
+}
+
+// Push returns false if the queue is full, duplicates count as queued
+func (q *Queue) Push(j *Job) bool {
+	q.l.Lock()
+	defer q.l.Unlock()
+	if _, ok := q.running[j.Key]; ok {
+		return true
+	}
+	if existing, ok := q.queued[j.Key]; ok {
+		if j.Request {
+			if existing.Request {
+				existing.Expires = common.LaterLease(existing.Expires, j.Expires)
+			} else {
+				existing.Expires = j.Expires
+			}
+			existing.Request = true
+		}
+		existing.Direct = existing.Direct && j.Direct
+		if j.Priority < existing.Priority {
+			// move up, keep the original queue time
+			q.classes[existing.Priority].remove(existing)
+			existing.Priority = j.Priority
+			q.perOrigin[existing.From]--
+			existing.From = j.From
+			q.perOrigin[existing.From]++
+			q.classes[existing.Priority].push(existing)
+		}
+		return true
+	}
+	if q.maxQueued > 0 && q.perOrigin[j.From] >= q.maxQueued {
+		q.dropped++
+		return false
+	}
+	j.Queued = time.Now()
+	q.queued[j.Key] = j
+	q.perOrigin[j.From]++
+	q.classes[j.Priority].push(j)
+	q.enqueued++
+	q.cond.Signal()
+	return true
+}
+
+// Pop blocks until there is work
+func (q *Queue) Pop() *Job {
+	q.l.Lock()
+	defer q.l.Unlock()
+	for {
+		for _, c := range q.classes {
+			if j := c.pop(); j != nil {
+				now := time.Now()
+				j.Started = &now
+				delete(q.queued, j.Key)
+				q.unqueued(j.From)
+				q.running[j.Key] = j
+				return j
+			}
+		}
+		q.cond.Wait()
+	}
+}
+
+func (q *Queue) unqueued(origin string) {
+	q.perOrigin[origin]--
+	if q.perOrigin[origin] <= 0 {
+		delete(q.perOrigin, origin)
+	}
+}
+
+func (q *Queue) Done(j *Job) {
+	q.l.Lock()
+	defer q.l.Unlock()
+	delete(q.running, j.Key)
+	q.completed++
+}
+
+// State is "queued", "running" or empty if the queue does not know key
+func (q *Queue) State(key string) string {
+	q.l.Lock()
+	defer q.l.Unlock()
+	if _, ok := q.running[key]; ok {
+		return "running"
+	}
+	if _, ok := q.queued[key]; ok {
+		return "queued"
+	}
+	return ""
+}
+
+func (q *Queue) Stats() Stats {
+	q.l.Lock()
+	defer q.l.Unlock()
+	s := Stats{
+		Workers:   q.workers,
+		Running:   len(q.running),
+		Queued:    map[string]int{},
+		PerOrigin: map[string]int{},
+		Enqueued:  q.enqueued,
+		Completed: q.completed,
+		Dropped:   q.dropped,
+		MaxQueued: q.maxQueued,
+	}
+	for i, c := range q.classes {
+		s.Queued[Priority(i).String()] = c.size
+	}
+	for origin, n := range q.perOrigin {
+		s.PerOrigin[origin] = n
+	}
+	return s
+}
+
+// Snapshot copies the running and queued jobs, queued ones by priority and age
+func (q *Queue) Snapshot() (running []Job, queued []Job) {
+	q.l.Lock()
+	defer q.l.Unlock()
+	running = []Job{}
+	queued = []Job{}
+	for _, j := range q.running {
+		running = append(running, *j)
+	}
+	for _, j := range q.queued {
+		queued = append(queued, *j)
+	}
+	sort.Slice(queued, func(a, b int) bool {
+		if queued[a].Priority != queued[b].Priority {
+			return queued[a].Priority < queued[b].Priority
+		}
+		return queued[a].Queued.Before(queued[b].Queued)
+	})
+	return running, queued
+}
@@ -0,0 +1,152 @@
+package pinqueue
+
+import (
+	"testing"
+	"time"
+)
+
+func job(key string, from string, priority Priority) *Job {
+	return &Job{Cid: key, Key: key, From: from, Priority: priority, Request: true}
+}
+
+// order pops n jobs, Pop blocks so n must not exceed what is queued
+func order(q *Queue, n int) []string {
+	keys := []string{}
+	for i := 0; i < n; i++ {
+		j := q.Pop()
+		keys = append(keys, j.Key)
+		q.Done(j)
+	}
+	return keys
+}
+
+func equal(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		jobs []*Job
+		want []string
+	}{
+		{"priority first", []*Job{
+			job("retry", "a", Transitive),
+			job("peer", "a", Trusted),
+			job("admin", "admin", Admin),
+		}, []string{"admin", "peer", "retry"}},
+		{"round-robin per origin", []*Job{
+			job("a1", "a", Trusted),
+			job("a2", "a", Trusted),
+			job("a3", "a", Trusted),
+			job("b1", "b", Trusted),
+			job("c1", "c", Trusted),
+			job("c2", "c", Trusted),
+		}, []string{"a1", "b1", "c1", "a2", "c2", "a3"}},
+		{"busy origin does not hold up other classes", []*Job{
+			job("a1", "a", Transitive),
+			job("a2", "a", Transitive),
+			job("b1", "b", Trusted),
+			job("a3", "a", Trusted),
+		}, []string{"b1", "a3", "a1", "a2"}},
+	}
+	for _, tt := range tests {
+		q := New(1, 0)
+		for _, j := range tt.jobs {
+			if !q.Push(j) {
+				t.Fatalf("%s: %s dropped", tt.name, j.Key)
+			}
+		}
+		if got := order(q, len(tt.jobs)); !equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDedup(t *testing.T) {
+	q := New(1, 0)
+	early := time.Now().Add(time.Hour)
+	late := early.Add(time.Hour)
+
+	first := job("x", "a", Transitive)
+	first.Expires = &early
+	q.Push(first)
+	queued := first.Queued
+	q.Push(job("other", "d", Transitive))
+
+	// asked again by someone more important, the job moves up and keeps its age
+	again := job("x", "b", Trusted)
+	again.Expires = &late
+	if !q.Push(again) {
+		t.Fatal("duplicate dropped")
+	}
+	retry := job("x", "c", Transitive)
+	retry.Request = false
+	q.Push(retry)
+
+	s := q.Stats()
+	if s.Enqueued != 2 || s.Queued["trusted"] != 1 || s.Queued["transitive"] != 1 {
+		t.Errorf("want one trusted job, got %+v", s)
+	}
+	if s.PerOrigin["a"] != 0 || s.PerOrigin["b"] != 1 {
+		t.Errorf("want the job counted for b, got %v", s.PerOrigin)
+	}
+	j := q.Pop()
+	if j != first || j.From != "b" || j.Priority != Trusted || !j.Queued.Equal(queued) {
+		t.Errorf("got %+v", j)
+	}
+	if j.Expires == nil || !j.Expires.Equal(late) {
+		t.Errorf("want the later lease, got %v", j.Expires)
+	}
+
+	// a running job is not queued again
+	if q.State("x") != "running" || !q.Push(job("x", "a", Admin)) || q.Stats().Queued["admin"] != 0 {
+		t.Error("running job was queued again")
+	}
+	q.Done(j)
+	if q.State("x") != "" || q.State("other") != "queued" {
+		t.Errorf("got states %q and %q", q.State("x"), q.State("other"))
+	}
+}
+
+func TestPermanentLeaseWins(t *testing.T) {
+	q := New(1, 0)
+	expires := time.Now().Add(time.Hour)
+	j := job("x", "a", Trusted)
+	j.Expires = &expires
+	q.Push(j)
+	q.Push(job("x", "b", Trusted))
+	if q.Pop().Expires != nil {
+		t.Error("want a permanent pin")
+	}
+}
+
+func TestMaxQueuedPerOrigin(t *testing.T) {
+	q := New(1, 2)
+	q.Push(job("a1", "a", Trusted))
+	q.Push(job("a2", "a", Trusted))
+	if q.Push(job("a3", "a", Trusted)) {
+		t.Error("third job of a accepted")
+	}
+	if !q.Push(job("a1", "a", Admin)) {
+		t.Error("duplicate of a queued job dropped")
+	}
+	if !q.Push(job("b1", "b", Trusted)) {
+		t.Error("b is limited by the jobs of a")
+	}
+	if s := q.Stats(); s.Dropped != 1 || s.PerOrigin["a"] != 2 {
+		t.Errorf("got %+v", s)
+	}
+	q.Done(q.Pop())
+	if !q.Push(job("a3", "a", Trusted)) {
+		t.Error("a is still full after a pop")
+	}
+}
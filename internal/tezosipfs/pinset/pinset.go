@@ -0,0 +1,186 @@
+package pinset
+
+import (
+	"context"
+	"errors"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipfs/go-merkledag"
+	"strings"
+)
+
+/*
+ * Pinset keeps the pins of the embedded node next to its blocks,
+ * one key per pin: /tezos-ipfs/pins/<recursive|direct>/<multihash>.
+ * Like the db (see common.CidKey) pins are keyed by multihash, so a v0
+ * and a v1 cid of the same content are the same pin. The value is the
+ * cid that was pinned, its codec matters when walking the DAG.
+ */
+
+const (
+	PREFIX    = "/tezos-ipfs/pins"
+	RECURSIVE = "recursive"
+	DIRECT    = "direct"
+)
+
+var kinds = []string{RECURSIVE, DIRECT}
+
+type Pinset struct {
+	ds datastore.Batching
+}
+
+func New(ds datastore.Batching) *Pinset {
+	return &Pinset{ds: ds}
+}
+
+func Key(kind string, c cid.Cid) datastore.Key {
+	return datastore.NewKey(PREFIX + "/" + kind + "/" + c.Hash().B58String())
+}
+
+func (p *Pinset) Add(kind string, c cid.Cid) error {
+	return p.ds.Put(Key(kind, c), c.Bytes())
+}
+
+// Remove drops both kinds of pins of the content of c, whatever cid version it was pinned as
+func (p *Pinset) Remove(c cid.Cid) error {
+	for _, kind := range kinds {
+		if err := p.ds.Delete(Key(kind, c)); err != nil && err != datastore.ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Pinset) Has(kind string, c cid.Cid) (bool, error) {
+	return p.ds.Has(Key(kind, c))
+}
+
+// List returns the pinned cids of kind
+func (p *Pinset) List(kind string) ([]cid.Cid, error) {
+	entries, err := p.entries(kind)
+	if err != nil {
+		return nil, err
+	}
+	pins := []cid.Cid{}
+	for _, e := range entries {
+		if c, err := pinned(kind, e); err == nil {
+			pins = append(pins, c)
+		}
+	}
+	return pins, nil
+}
+
+func (p *Pinset) entries(kind string) ([]query.Entry, error) {
+	res, err := p.ds.Query(query.Query{Prefix: PREFIX + "/" + kind})
+	if err != nil {
+		return nil, err
+	}
+	return res.Rest()
+}
+
+// pinned reads the cid of an entry, pins from before Migrate have it in the key only
+func pinned(kind string, e query.Entry) (cid.Cid, error) {
+	if len(e.Value) > 0 {
+		if _, c, err := cid.CidFromBytes(e.Value); err == nil {
+			return c, nil
+		}
+	}
+	return cid.Decode(strings.TrimPrefix(e.Key, PREFIX+"/"+kind+"/"))
+}
+
+/*
+ * Migrate re-keys pins stored under their cid string by multihash,
+ * returns how many were moved. Entries that are not a cid stay as they are.
+ */
+func (p *Pinset) Migrate() (int, error) {
+	b, err := p.ds.Batch()
+	if err != nil {
+		return 0, err
+	}
+	moved := 0
+	for _, kind := range kinds {
+		entries, err := p.entries(kind)
+		if err != nil {
+			return 0, err
+		}
+		for _, e := range entries {
+			c, err := pinned(kind, e)
+			if err != nil {
+				continue
+			}
+			key := Key(kind, c)
+			if key.String() == e.Key && len(e.Value) > 0 {
+				continue
+			}
+			if err := b.Put(key, c.Bytes()); err != nil {
+				return 0, err
+			}
+			if key.String() != e.Key {
+				if err := b.Delete(datastore.NewKey(e.Key)); err != nil {
+					return 0, err
+				}
+			}
+			moved++
+		}
+	}
+	return moved, b.Commit()
+}
+
+/*
+ * Mark collects the multihashes of all pinned blocks in bs, using local
+ * blocks only. A recursive pin with missing blocks does not stop it, the
+ * blocks we can reach are kept and the pin is returned in incomplete with
+ * the number of blocks that could not be loaded.
+ */
+func (p *Pinset) Mark(ctx context.Context, bs blockstore.Blockstore) (keep map[string]bool, incomplete map[string]int, err error) {
+	dag := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+	keep = map[string]bool{}
+	incomplete = map[string]int{}
+
+	recursive, err := p.List(RECURSIVE)
+	if err != nil {
+		return nil, nil, err
+	}
+	visited := cid.NewSet()
+	for _, c := range recursive {
+		missing := 0
+		err = merkledag.Walk(ctx, merkledag.GetLinksDirect(dag), c, visited.Visit,
+			merkledag.OnError(func(_ cid.Cid, err error) error {
+				if ctx.Err() != nil {
+					return err
+				}
+				// an incomplete pin must not hold up the collection of everything else
+				missing++
+				return nil
+			}))
+		if err != nil {
+			return nil, nil, errors.New(c.String() + ": " + err.Error())
+		}
+		if missing > 0 {
+			incomplete[c.String()] = missing
+		}
+	}
+	visited.ForEach(func(c cid.Cid) error {
+		keep[string(c.Hash())] = true
+		return nil
+	})
+
+	direct, err := p.List(DIRECT)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, c := range direct {
+		keep[string(c.Hash())] = true
+	}
+	return keep, incomplete, nil
+}
+
+// Complete fails if a block of the DAG of c is not in bs
+func Complete(ctx context.Context, bs blockstore.Blockstore, c cid.Cid) error {
+	dag := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+	return merkledag.Walk(ctx, merkledag.GetLinksDirect(dag), c, cid.NewSet().Visit)
+}
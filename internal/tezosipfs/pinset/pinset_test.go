@@ -0,0 +1,127 @@
+package pinset
+
+import (
+	"context"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"testing"
+)
+
+func newPinset() (*Pinset, datastore.Batching) {
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	return New(ds), ds
+}
+
+func node(t *testing.T, data string, links ...ipld.Node) *merkledag.ProtoNode {
+	n := merkledag.NodeWithData([]byte(data))
+	n.SetCidBuilder(merkledag.V1CidPrefix())
+	for i, l := range links {
+		if err := n.AddNodeLink(string(rune('a'+i)), l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return n
+}
+
+func TestRemoveAnyVersion(t *testing.T) {
+	p, _ := newPinset()
+	v1 := node(t, "upload").Cid()
+	v0 := cid.NewCidV0(v1.Hash())
+	if err := p.Add(RECURSIVE, v1); err != nil {
+		t.Fatal(err)
+	}
+	pins, _ := p.List(RECURSIVE)
+	if len(pins) != 1 || !pins[0].Equals(v1) {
+		t.Fatalf("want the pinned cid %s, got %v", v1, pins)
+	}
+	// uploads hand out the v0 form, blocking or unpinning uses that
+	if err := p.Remove(v0); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := p.Has(RECURSIVE, v1); has {
+		t.Error("pin survived removal by its v0 cid")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	p, ds := newPinset()
+	v1 := node(t, "v1").Cid()
+	v0 := cid.NewCidV0(node(t, "v0").Cid().Hash())
+	ds.Put(datastore.NewKey(PREFIX+"/"+RECURSIVE+"/"+v1.String()), []byte{})
+	ds.Put(datastore.NewKey(PREFIX+"/"+DIRECT+"/"+v0.String()), []byte{})
+	ds.Put(datastore.NewKey(PREFIX+"/"+RECURSIVE+"/not-a-cid"), []byte{})
+
+	moved, err := p.Migrate()
+	if err != nil || moved != 2 {
+		t.Fatalf("want 2 moved, got %d, %v", moved, err)
+	}
+	if has, _ := ds.Has(datastore.NewKey(PREFIX + "/" + RECURSIVE + "/" + v1.String())); has {
+		t.Error("old key of the v1 pin is still there")
+	}
+	for kind, c := range map[string]cid.Cid{RECURSIVE: v1, DIRECT: v0} {
+		if has, _ := p.Has(kind, c); !has {
+			t.Errorf("%s pin %s is missing after the migration", kind, c)
+		}
+	}
+	pins, _ := p.List(RECURSIVE)
+	if len(pins) != 1 || !pins[0].Equals(v1) {
+		t.Errorf("want the v1 cid listed, got %v", pins)
+	}
+	if moved, _ := p.Migrate(); moved != 0 {
+		t.Errorf("second run moved %d", moved)
+	}
+}
+
+func TestMarkIncomplete(t *testing.T) {
+	ctx := context.Background()
+	p, ds := newPinset()
+	bs := blockstore.NewBlockstore(ds)
+	dag := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+
+	leaf := node(t, "leaf")
+	kept := node(t, "kept")
+	lost := node(t, "lost", leaf)
+	root := node(t, "root", kept, lost)
+	other := node(t, "other")
+	garbage := node(t, "garbage")
+	for _, n := range []ipld.Node{leaf, kept, lost, root, other, garbage} {
+		if err := dag.Add(ctx, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.Add(RECURSIVE, root.Cid())
+	p.Add(DIRECT, other.Cid())
+
+	if err := Complete(ctx, bs, root.Cid()); err != nil {
+		t.Fatal("complete DAG: ", err)
+	}
+	bs.DeleteBlock(lost.Cid())
+	if err := Complete(ctx, bs, root.Cid()); err == nil {
+		t.Error("want an error for an incomplete DAG")
+	}
+
+	keep, incomplete, err := p.Mark(ctx, bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []ipld.Node{root, kept, other} {
+		if !keep[string(n.Cid().Hash())] {
+			t.Errorf("%s not kept", n.Cid())
+		}
+	}
+	// below the missing block we can not see, leaf is collected
+	for _, n := range []ipld.Node{garbage, leaf} {
+		if keep[string(n.Cid().Hash())] {
+			t.Errorf("%s kept", n.Cid())
+		}
+	}
+	if incomplete[root.Cid().String()] != 1 {
+		t.Errorf("want root reported with 1 missing block, got %v", incomplete)
+	}
+}
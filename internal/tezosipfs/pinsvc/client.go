@@ -0,0 +1,96 @@
+package pinsvc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var ErrNotFound = errors.New("pin request not found")
+
+// Client talks to a remote pinning service
+type Client struct {
+	endpoint string
+	token    string
+	http     *http.Client
+}
+
+func NewClient(endpoint string, token string) *Client {
+	return &Client{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		token:    token,
+		http:     &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (c *Client) Add(p Pin) (*PinStatus, error) {
+	res := &PinStatus{}
+	return res, c.do("POST", "/pins", p, res)
+}
+
+func (c *Client) Get(requestID string) (*PinStatus, error) {
+	res := &PinStatus{}
+	return res, c.do("GET", "/pins/"+url.PathEscape(requestID), nil, res)
+}
+
+func (c *Client) Replace(requestID string, p Pin) (*PinStatus, error) {
+	res := &PinStatus{}
+	return res, c.do("POST", "/pins/"+url.PathEscape(requestID), p, res)
+}
+
+func (c *Client) Delete(requestID string) error {
+	return c.do("DELETE", "/pins/"+url.PathEscape(requestID), nil, nil)
+}
+
+// List passes query as filters, e.g. cid, status or limit
+func (c *Client) List(query url.Values) (*PinResults, error) {
+	res := &PinResults{}
+	path := "/pins"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	return res, c.do("GET", path, nil, res)
+}
+
+func (c *Client) do(method string, path string, body interface{}, res interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.endpoint+path, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 404 {
+		return ErrNotFound
+	}
+	if resp.StatusCode >= 300 {
+		f := Failure{}
+		if json.NewDecoder(resp.Body).Decode(&f) == nil && f.Error.Reason != "" {
+			return errors.New(resp.Status + ": " + f.Error.Reason + " " + f.Error.Details)
+		}
+		return errors.New(resp.Status)
+	}
+	if res == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(res)
+}
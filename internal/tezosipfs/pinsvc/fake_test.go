@@ -0,0 +1,120 @@
+package pinsvc
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * FakeService is an in-process pinning service for the tests,
+ * requests move to Status after Polls reads
+ */
+type FakeService struct {
+	URL    string
+	Token  string
+	Status string // final status, pinned by default
+	Polls  int    // reads before a request reaches Status
+	server *httptest.Server
+	l      *sync.Mutex
+	pins   map[string]*fakePin
+	next   int
+}
+
+type fakePin struct {
+	status PinStatus
+	reads  int
+}
+
+func NewFakeService(token string) *FakeService {
+	f := &FakeService{
+		Token:  token,
+		Status: StatusPinned,
+		l:      &sync.Mutex{},
+		pins:   map[string]*fakePin{},
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	f.URL = f.server.URL
+	return f
+}
+
+func (f *FakeService) Close() {
+	f.server.Close()
+}
+
+// Pins returns the current requests by request id
+func (f *FakeService) Pins() map[string]PinStatus {
+	f.l.Lock()
+	defer f.l.Unlock()
+	res := map[string]PinStatus{}
+	for id, p := range f.pins {
+		res[id] = p.status
+	}
+	return res
+}
+
+func (f *FakeService) serve(w http.ResponseWriter, r *http.Request) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	if r.Header.Get("Authorization") != "Bearer "+f.Token {
+		f.write(w, 401, NewFailure("UNAUTHORIZED", ""))
+		return
+	}
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/pins"), "/")
+	switch {
+	case r.Method == "GET" && id == "":
+		res := PinResults{Results: []PinStatus{}}
+		for _, p := range f.pins {
+			res.Results = append(res.Results, p.status)
+		}
+		res.Count = len(res.Results)
+		f.write(w, 200, res)
+	case r.Method == "POST" && id == "":
+		f.add(w, r)
+	case f.pins[id] == nil:
+		f.write(w, 404, NewFailure("NOT_FOUND", ""))
+	case r.Method == "GET":
+		p := f.pins[id]
+		p.reads++
+		if p.reads > f.Polls {
+			p.status.Status = f.Status
+		}
+		f.write(w, 200, p.status)
+	case r.Method == "POST":
+		delete(f.pins, id)
+		f.add(w, r)
+	case r.Method == "DELETE":
+		delete(f.pins, id)
+		w.WriteHeader(202)
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+func (f *FakeService) add(w http.ResponseWriter, r *http.Request) {
+	p := Pin{}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil || p.Cid == "" {
+		f.write(w, 400, NewFailure("BAD_REQUEST", "invalid pin"))
+		return
+	}
+	f.next++
+	status := PinStatus{
+		RequestID: strconv.Itoa(f.next),
+		Status:    StatusQueued,
+		Created:   time.Now(),
+		Pin:       p,
+		Delegates: []string{},
+	}
+	f.pins[status.RequestID] = &fakePin{status: status}
+	f.write(w, 202, status)
+}
+
+func (f *FakeService) write(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,49 @@
+package pinsvc
+
+import "time"
+
+/*
+ * Types of the IPFS Pinning Service API
+ * https://ipfs.github.io/pinning-services-api-spec/
+ */
+
+const (
+	StatusQueued  = "queued"
+	StatusPinning = "pinning"
+	StatusPinned  = "pinned"
+	StatusFailed  = "failed"
+)
+
+type Pin struct {
+	Cid     string            `json:"cid"`
+	Name    string            `json:"name,omitempty"`
+	Origins []string          `json:"origins,omitempty"`
+	Meta    map[string]string `json:"meta,omitempty"`
+}
+
+type PinStatus struct {
+	RequestID string            `json:"requestid"`
+	Status    string            `json:"status"`
+	Created   time.Time         `json:"created"`
+	Pin       Pin               `json:"pin"`
+	Delegates []string          `json:"delegates"`
+	Info      map[string]string `json:"info,omitempty"`
+}
+
+type PinResults struct {
+	Count   int         `json:"count"`
+	Results []PinStatus `json:"results"`
+}
+
+type Failure struct {
+	Error FailureError `json:"error"`
+}
+
+type FailureError struct {
+	Reason  string `json:"reason"`
+	Details string `json:"details,omitempty"`
+}
+
+func NewFailure(reason string, details string) Failure {
+	return Failure{Error: FailureError{Reason: reason, Details: details}}
+}
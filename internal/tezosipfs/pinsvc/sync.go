@@ -0,0 +1,63 @@
+package pinsvc
+
+import (
+	"errors"
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/common"
+	"time"
+)
+
+// PollInterval between two status checks of a request in progress
+const PollInterval = time.Minute
+
+/*
+ * Sync moves the copy r of a pin on the service of client one step:
+ * a "new" copy is requested, replacing a former request if there is one,
+ * any other is polled. Failures go back to "new" with backoff, after
+ * maxAttempts the copy is "failed". The caller saves r, the error is
+ * the failure of this step.
+ */
+func Sync(client *Client, r *common.RemotePin, origins []string, maxAttempts int, backoff func(attempts int) time.Duration) error {
+	var status *PinStatus
+	var err error
+	if r.Status == "new" {
+		p := Pin{
+			Cid:     r.Ref(),
+			Origins: origins,
+		}
+		if r.RequestID != "" {
+			status, err = client.Replace(r.RequestID, p)
+		}
+		if r.RequestID == "" || err == ErrNotFound {
+			status, err = client.Add(p)
+		}
+	} else {
+		status, err = client.Get(r.RequestID)
+	}
+	if err == nil && status.Status == StatusFailed {
+		err = errors.New("remote service failed to pin")
+		if details, ok := status.Info["status_details"]; ok {
+			err = errors.New("remote service failed to pin: " + details)
+		}
+	}
+	if status != nil && status.RequestID != "" {
+		r.RequestID = status.RequestID
+	}
+	r.Updated = time.Now()
+	if err != nil {
+		r.Attempts++
+		r.LastError = err.Error()
+		if r.Attempts >= maxAttempts {
+			r.Status = "failed"
+		} else {
+			r.Status = "new"
+			r.NextAttempt = time.Now().Add(backoff(r.Attempts))
+		}
+		return err
+	}
+	r.Status = status.Status
+	r.LastError = ""
+	if r.Status != StatusPinned {
+		r.NextAttempt = time.Now().Add(PollInterval)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package pinsvc
+
+import (
+	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/common"
+	"testing"
+	"time"
+)
+
+const testCid = "QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG"
+
+func testBackoff(attempts int) time.Duration {
+	return time.Duration(attempts) * time.Minute
+}
+
+func TestSyncNewQueuedPinned(t *testing.T) {
+	f := NewFakeService("secret")
+	defer f.Close()
+	f.Polls = 1
+	client := NewClient(f.URL, "secret")
+	r := &common.RemotePin{Cid: testCid, Status: "new"}
+
+	if err := Sync(client, r, nil, 3, testBackoff); err != nil {
+		t.Fatal(err)
+	}
+	if r.Status != StatusQueued || r.RequestID == "" {
+		t.Fatalf("expected a queued request, got %q %q", r.Status, r.RequestID)
+	}
+	if !r.NextAttempt.After(time.Now()) {
+		t.Fatal("expected the next poll to be scheduled")
+	}
+	if got := f.Pins()[r.RequestID].Pin.Cid; got != testCid {
+		t.Fatalf("requested %q, want %q", got, testCid)
+	}
+
+	// first poll, still queued
+	if err := Sync(client, r, nil, 3, testBackoff); err != nil {
+		t.Fatal(err)
+	}
+	if r.Status != StatusQueued {
+		t.Fatalf("expected queued, got %q", r.Status)
+	}
+	if err := Sync(client, r, nil, 3, testBackoff); err != nil {
+		t.Fatal(err)
+	}
+	if r.Status != StatusPinned || r.Attempts != 0 {
+		t.Fatalf("expected pinned without failed attempts, got %q after %d", r.Status, r.Attempts)
+	}
+}
+
+func TestSyncRequestsOriginal(t *testing.T) {
+	f := NewFakeService("secret")
+	defer f.Close()
+	client := NewClient(f.URL, "secret")
+	original := "bafybeihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku"
+	r := &common.RemotePin{Cid: testCid, Original: original, Status: "new"}
+	if err := Sync(client, r, nil, 3, testBackoff); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.Pins()[r.RequestID].Pin.Cid; got != original {
+		t.Fatalf("requested %q, want %q", got, original)
+	}
+}
+
+func TestSyncReplaceFallsBackToAdd(t *testing.T) {
+	f := NewFakeService("secret")
+	defer f.Close()
+	client := NewClient(f.URL, "secret")
+
+	// the service forgot about our former request
+	r := &common.RemotePin{Cid: testCid, Status: "new", RequestID: "gone"}
+	if err := Sync(client, r, nil, 3, testBackoff); err != nil {
+		t.Fatal(err)
+	}
+	if r.RequestID == "gone" || r.Status != StatusQueued {
+		t.Fatalf("expected a new queued request, got %q %q", r.Status, r.RequestID)
+	}
+
+	// a known request is replaced
+	former := r.RequestID
+	r.Status = "new"
+	if err := Sync(client, r, nil, 3, testBackoff); err != nil {
+		t.Fatal(err)
+	}
+	pins := f.Pins()
+	if _, ok := pins[former]; ok {
+		t.Fatal("expected the former request to be replaced")
+	}
+	if len(pins) != 1 || r.RequestID == former {
+		t.Fatalf("expected one new request, got %d", len(pins))
+	}
+}
+
+func TestSyncFailureBackoff(t *testing.T) {
+	f := NewFakeService("secret")
+	defer f.Close()
+	f.Status = StatusFailed
+	client := NewClient(f.URL, "secret")
+	r := &common.RemotePin{Cid: testCid, Status: "new"}
+
+	if err := Sync(client, r, nil, 2, testBackoff); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := Sync(client, r, nil, 2, testBackoff); err == nil {
+		t.Fatal("expected the failed status to be an error")
+	}
+	if r.Status != "new" || r.Attempts != 1 || r.LastError == "" {
+		t.Fatalf("expected a retry, got %q after %d attempts", r.Status, r.Attempts)
+	}
+	if r.NextAttempt.Before(start.Add(testBackoff(1))) {
+		t.Fatal("expected the retry to wait for the backoff")
+	}
+
+	// the retry asks again and fails for good
+	if err := Sync(client, r, nil, 2, testBackoff); err != nil {
+		t.Fatal(err)
+	}
+	if err := Sync(client, r, nil, 2, testBackoff); err == nil {
+		t.Fatal("expected the failed status to be an error")
+	}
+	if r.Status != "failed" || r.Attempts != 2 {
+		t.Fatalf("expected failed after 2 attempts, got %q after %d", r.Status, r.Attempts)
+	}
+}
+
+func TestSyncUnauthorized(t *testing.T) {
+	f := NewFakeService("secret")
+	defer f.Close()
+	client := NewClient(f.URL, "wrong")
+	r := &common.RemotePin{Cid: testCid, Status: "new"}
+	if err := Sync(client, r, nil, 3, testBackoff); err == nil {
+		t.Fatal("expected an error")
+	}
+	if r.Status != "new" || r.Attempts != 1 || r.RequestID != "" {
+		t.Fatalf("expected a retry without request, got %q %q after %d", r.Status, r.RequestID, r.Attempts)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/tezoscommons/tezos-ipfs/internal/tezosipfs/network"
+	"time"
 )
 
 type PeerAdvertisment struct {
@@ -34,4 +35,80 @@ type PinRequest struct {
 	Cid string
 	Data []byte // if small, files, distribute via pubsub directly
                 // a small file is <= 256kb, so most json files, metadata etc
-}
\ No newline at end of file
+	Expires  *time.Time `json:",omitempty"` // lease, nil pins permanently
+	Network  string     `json:",omitempty"` // federation of a direct request, pubsub messages carry their own
+	Direct   bool       `json:",omitempty"` // storage peers were asked over a stream
+	Fallback []string   `json:",omitempty"` // with Direct, the storage peers that pin from the announcement
+}
+
+// PinnedBy is false for storage peers that got the request over a stream already
+func (p *PinRequest) PinnedBy(peer string) bool {
+	if !p.Direct {
+		return true
+	}
+	for _, f := range p.Fallback {
+		if f == peer {
+			return true
+		}
+	}
+	return false
+}
+
+// ToTransportFormat sends a plain cid if nothing else is set, older nodes only understand those
+func (p *PinRequest) ToTransportFormat() *network.PubSubMessage {
+	res := network.PubSubMessage{
+		Data: []byte(p.Cid),
+		Kind: "new_object",
+	}
+	if p.Expires != nil || len(p.Data) > 0 || p.Direct {
+		b, e := json.Marshal(*p)
+		if e != nil {
+			fmt.Println(e)
+		}
+		res.Data = b
+	}
+	return &res
+}
+
+// ParsePinRequest reads a new_object message, either json or a plain cid
+func ParsePinRequest(data []byte) (*PinRequest, error) {
+	p := PinRequest{}
+	if len(data) > 0 && data[0] == '{' {
+		if err := json.Unmarshal(data, &p); err != nil {
+			return nil, err
+		}
+		return &p, nil
+	}
+	p.Cid = string(data)
+	return &p, nil
+}
+
+// PinAck answers a pin request on a direct stream, "queued" first, then the outcome
+type PinAck struct {
+	Cid    string
+	Status string // queued, pinned, rejected or failed
+	Error  string `json:",omitempty"`
+}
+
+// Final is true once the storage node will not send anything else
+func (a *PinAck) Final() bool {
+	return a.Status != "queued"
+}
+
+// PinRejection tells Origin that we refused to pin Cid
+type PinRejection struct {
+	Cid    string
+	Origin string
+	Reason string
+}
+
+func (p *PinRejection) ToTransportFormat() *network.PubSubMessage {
+	b, e := json.Marshal(*p)
+	if e != nil {
+		fmt.Println(e)
+	}
+	return &network.PubSubMessage{
+		Data: b,
+		Kind: "pin_rejected",
+	}
+}
@@ -14,23 +14,41 @@ import (
  * the nodes we care about
  */
 type Swarm struct {
+	trustedPeers []string // directly or 2nd level peers, of all federations
+	feds         map[string]*Federation
+	l            *sync.Mutex
+	log          *logrus.Entry
+	net          network.NetworkInterface
+	config       *config.Config
+}
+
+// Federation holds the trust lists and the advertisements of one federation
+type Federation struct {
 	trustedPeers  []string // directly or 2nd level peers
 	knownPeers    map[string]*PeerAdvertisment
 	knownPeersTTL map[string]time.Time // stores last update
 	cacheFor      []string
 	pinFor        []string
-	l             *sync.Mutex
-	log           *logrus.Entry
-	net           network.NetworkInterface
-	config        *config.Config
+}
+
+func newFederation() *Federation {
+	return &Federation{
+		trustedPeers:  []string{},
+		knownPeers:    map[string]*PeerAdvertisment{},
+		knownPeersTTL: map[string]time.Time{},
+		cacheFor:      []string{},
+		pinFor:        []string{},
+	}
 }
 
 func NewSwarm(c *config.Config, l *logrus.Entry, net network.NetworkInterface) *Swarm {
 	s := Swarm{}
 	s.log = l.WithField("source", "swarm")
 	s.l = &sync.Mutex{}
-	s.knownPeers = map[string]*PeerAdvertisment{}
-	s.knownPeersTTL = map[string]time.Time{}
+	s.feds = map[string]*Federation{}
+	for _, f := range c.Federations() {
+		s.feds[f.Name] = newFederation()
+	}
 	s.trustedPeers = []string{}
 	s.net = net
 	s.config = c
@@ -47,27 +65,38 @@ func (s *Swarm) updateConfig(c *config.Config) {
 	ch := c.GetUpdates()
 	for {
 		newConfig := <-ch
-		newaddrs := []string{}
-		for _, a := range newConfig.Peers.CacheFor {
-			newaddrs = append(newaddrs, a)
-		}
-		for _, a := range newConfig.Peers.PinFor {
-			newaddrs = append(newaddrs, a)
-		}
-		for _, a := range newConfig.Peers.TrustedPeers {
-			newaddrs = append(newaddrs, a)
-		}
-
+		all := []string{}
 		s.l.Lock()
-		s.pinFor = newConfig.Peers.PinFor
-		s.cacheFor = newConfig.Peers.CacheFor
-		s.trustedPeers = unique(newaddrs)
+		for _, f := range newConfig.Federations() {
+			newaddrs := []string{}
+			for _, a := range f.Peers.CacheFor {
+				newaddrs = append(newaddrs, a)
+			}
+			for _, a := range f.Peers.PinFor {
+				newaddrs = append(newaddrs, a)
+			}
+			for _, a := range f.Peers.TrustedPeers {
+				newaddrs = append(newaddrs, a)
+			}
+			fed, ok := s.feds[f.Name]
+			if !ok {
+				// we only listen to the federations we started with
+				s.log.WithField("federation", f.Name).Warn("new federations need a restart")
+				continue
+			}
+			fed.pinFor = f.Peers.PinFor
+			fed.cacheFor = f.Peers.CacheFor
+			fed.trustedPeers = unique(newaddrs)
+			all = append(all, fed.trustedPeers...)
+		}
+		s.trustedPeers = unique(all)
 		s.l.Unlock()
 		go s.connect()
 	}
 
 }
 
+// advertiseMyself tells every federation what we do for its members
 func (s *Swarm) advertiseMyself() {
 	msg := PeerAdvertisment{
 		Name:         s.config.Identity.Name,
@@ -77,10 +106,12 @@ func (s *Swarm) advertiseMyself() {
 	}
 	for {
 		time.Sleep(5 * time.Second)
-		msg.TrustedPeers = s.config.Peers.TrustedPeers
-		msg.CacheFor = s.config.Peers.CacheFor
-		msg.PinFor = s.config.Peers.PinFor
-		s.net.SendMessage(msg.toTransportFormat())
+		for _, f := range s.config.Federations() {
+			msg.TrustedPeers = f.Peers.TrustedPeers
+			msg.CacheFor = f.Peers.CacheFor
+			msg.PinFor = f.Peers.PinFor
+			s.net.SendMessageTo(f.Name, msg.toTransportFormat())
+		}
 	}
 }
 
@@ -94,7 +125,10 @@ func (s *Swarm) connect() {
 func (s *Swarm) periodic() {
 	for {
 		time.Sleep(15 * time.Second)
-		s.net.Connect(s.trustedPeers)
+		s.l.Lock()
+		cp := s.trustedPeers
+		s.l.Unlock()
+		s.net.Connect(cp)
 	}
 }
 
@@ -103,32 +137,44 @@ func (s *Swarm) purgePeers() {
 	timeout := 20 * time.Second
 	for {
 		time.Sleep(10 * time.Second)
-		for id, t := range s.knownPeersTTL {
-			if time.Now().Add(-1 * timeout).After(t) {
-				s.l.Lock()
-				delete(s.knownPeersTTL, id)
-				delete(s.knownPeers, id)
-				s.l.Unlock()
+		s.l.Lock()
+		for _, fed := range s.feds {
+			for id, t := range fed.knownPeersTTL {
+				if time.Now().Add(-1 * timeout).After(t) {
+					delete(fed.knownPeersTTL, id)
+					delete(fed.knownPeers, id)
+				}
 			}
 		}
+		s.l.Unlock()
 	}
 }
 
 func (s *Swarm) subscribe() {
-	ch := s.net.Subscribe()
-	for {
-		msg := <-ch
+	// advertisements repeat, only the latest ones matter
+	sub := s.net.Events().Subscribe(network.SubscribeOptions{
+		Name:   "swarm",
+		Kinds:  []string{"peer_advertisement"},
+		Policy: network.DropOldest,
+	})
+	for msg := range sub.C {
 		if msg.Kind == "peer_advertisement" {
 			padv := PeerAdvertisment{}
 			json.Unmarshal(msg.Data, &padv)
 			padv.PeerId = msg.From
 			s.l.Lock()
-			s.knownPeers[padv.PeerId] = &padv
-			s.knownPeersTTL[padv.PeerId] = time.Now()
-			for _, trusted := range s.config.Peers.TrustedPeers {
+			fed, ok := s.feds[msg.Network]
+			if !ok {
+				s.l.Unlock()
+				continue
+			}
+			fed.knownPeers[padv.PeerId] = &padv
+			fed.knownPeersTTL[padv.PeerId] = time.Now()
+			for _, trusted := range s.peersOf(msg.Network).TrustedPeers {
 				if trusted == padv.PeerId {
-					s.trustedPeers = append(s.trustedPeers, padv.TrustedPeers...)
-					s.trustedPeers = unique(s.trustedPeers)
+					// trust is transitive within a federation only
+					fed.trustedPeers = unique(append(fed.trustedPeers, padv.TrustedPeers...))
+					s.trustedPeers = unique(append(s.trustedPeers, padv.TrustedPeers...))
 				}
 			}
 			s.l.Unlock()
@@ -136,6 +182,16 @@ func (s *Swarm) subscribe() {
 	}
 }
 
+// peersOf returns the configured lists of federation name
+func (s *Swarm) peersOf(name string) config.Peers {
+	for _, f := range s.config.Federations() {
+		if f.Name == name {
+			return f.Peers
+		}
+	}
+	return config.Peers{}
+}
+
 func unique(stringSlice []string) []string {
 	keys := make(map[string]bool)
 	list := []string{}
@@ -148,55 +204,98 @@ func unique(stringSlice []string) []string {
 	return list
 }
 
+func contains(list []string, pid string) bool {
+	for _, a := range list {
+		if a == pid {
+			return true
+		}
+	}
+	return false
+}
+
+// PinFor is true if we pin for pid in any of our federations
 func (s *Swarm) PinFor(pid string) bool {
 	s.l.Lock()
 	defer s.l.Unlock()
-	for _, a := range s.pinFor {
-		if a == pid {
+	for _, fed := range s.feds {
+		if contains(fed.pinFor, pid) {
 			return true
 		}
 	}
 	return false
 }
 
+// PinForIn is true if we pin for pid in federation network
+func (s *Swarm) PinForIn(network string, pid string) bool {
+	s.l.Lock()
+	defer s.l.Unlock()
+	fed, ok := s.feds[network]
+	return ok && contains(fed.pinFor, pid)
+}
+
+// CacheFor is true if we cache for pid in any of our federations
 func (s *Swarm) CacheFor(pid string) bool {
 	s.l.Lock()
 	defer s.l.Unlock()
-	for _, a := range s.cacheFor {
-		if a == pid {
+	for _, fed := range s.feds {
+		if contains(fed.cacheFor, pid) {
 			return true
 		}
 	}
 	return false
 }
 
+// CacheForIn is true if we cache for pid in federation network
+func (s *Swarm) CacheForIn(network string, pid string) bool {
+	s.l.Lock()
+	defer s.l.Unlock()
+	fed, ok := s.feds[network]
+	return ok && contains(fed.cacheFor, pid)
+}
+
 func (s *Swarm) IsTrusted(pid string) bool {
 	s.l.Lock()
 	defer s.l.Unlock()
-	for _, a := range s.trustedPeers {
-		if a == pid {
-			return true
-		}
-	}
-	for _, a := range s.cacheFor {
-		if a == pid {
+	for _, fed := range s.feds {
+		if contains(fed.trustedPeers, pid) || contains(fed.cacheFor, pid) || contains(fed.pinFor, pid) {
 			return true
 		}
 	}
-	for _, a := range s.pinFor {
-		if a == pid {
-			return true
+	return false
+}
+
+// Advertisement is the last advertisement of pid, nil if we have none
+func (s *Swarm) Advertisement(pid string) *PeerAdvertisment {
+	s.l.Lock()
+	defer s.l.Unlock()
+	for _, f := range s.config.Federations() {
+		if fed, ok := s.feds[f.Name]; ok && fed.knownPeers[pid] != nil {
+			return fed.knownPeers[pid]
 		}
 	}
-	return false
+	return nil
 }
 
+// CacheForUs are the peers caching for us, in any federation
 func (s *Swarm) CacheForUs() []*PeerAdvertisment {
+	return s.forUs(func(a *PeerAdvertisment) []string { return a.CacheFor })
+}
+
+// PinForUs are the peers pinning for us, in any federation
+func (s *Swarm) PinForUs() []*PeerAdvertisment {
+	return s.forUs(func(a *PeerAdvertisment) []string { return a.PinFor })
+}
+
+func (s *Swarm) forUs(list func(*PeerAdvertisment) []string) []*PeerAdvertisment {
+	s.l.Lock()
+	defer s.l.Unlock()
 	res := []*PeerAdvertisment{}
+	seen := map[string]bool{}
 	id := s.net.ID()
-	for _, a := range s.knownPeers {
-		for _, b := range a.CacheFor {
-			if b == id {
+	for _, fed := range s.feds {
+		for _, a := range fed.knownPeers {
+			if !seen[a.PeerId] && contains(list(a), id) {
+				seen[a.PeerId] = true
 				res = append(res, a)
 			}
 		}
@@ -204,15 +303,97 @@ func (s *Swarm) CacheForUs() []*PeerAdvertisment {
 	return res
 }
 
-func (s *Swarm) PinForUs() []*PeerAdvertisment {
-	res := []*PeerAdvertisment{}
+// PinsForUs is true if pid advertised to pin for us in federation network
+func (s *Swarm) PinsForUs(network string, pid string) bool {
+	return s.forUsIn(network, pid, func(a *PeerAdvertisment) []string { return a.PinFor })
+}
+
+// CachesForUs is true if pid advertised to cache for us in federation network
+func (s *Swarm) CachesForUs(network string, pid string) bool {
+	return s.forUsIn(network, pid, func(a *PeerAdvertisment) []string { return a.CacheFor })
+}
+
+func (s *Swarm) forUsIn(network string, pid string, list func(*PeerAdvertisment) []string) bool {
+	s.l.Lock()
+	defer s.l.Unlock()
+	fed, ok := s.feds[network]
+	if !ok {
+		return false
+	}
+	a, ok := fed.knownPeers[pid]
+	return ok && contains(list(a), s.net.ID())
+}
+
+// ForUsIn are the federations with peers pinning or caching for us, where we announce uploads
+func (s *Swarm) ForUsIn() []string {
+	s.l.Lock()
+	defer s.l.Unlock()
+	res := []string{}
 	id := s.net.ID()
-	for _, a := range s.knownPeers {
-		for _, b := range a.PinFor {
-			if b == id {
-				res = append(res, a)
+	for _, f := range s.config.Federations() {
+		fed, ok := s.feds[f.Name]
+		if !ok {
+			continue
+		}
+		for _, a := range fed.knownPeers {
+			if contains(a.PinFor, id) || contains(a.CacheFor, id) {
+				res = append(res, f.Name)
+				break
 			}
 		}
 	}
 	return res
 }
+
+// FederationsOf are the federations pid is a member of, or advertised itself in
+func (s *Swarm) FederationsOf(pid string) []string {
+	s.l.Lock()
+	defer s.l.Unlock()
+	res := []string{}
+	for _, f := range s.config.Federations() {
+		fed, ok := s.feds[f.Name]
+		if !ok {
+			continue
+		}
+		if contains(fed.trustedPeers, pid) || contains(fed.pinFor, pid) || contains(fed.cacheFor, pid) || fed.knownPeers[pid] != nil {
+			res = append(res, f.Name)
+		}
+	}
+	return res
+}
+
+// FederationStats counts the peers of a federation
+type FederationStats struct {
+	Known      int // peers that advertised themselves recently
+	Trusted    int // including those trusted by trusted peers
+	PinFor     int
+	CacheFor   int
+	PinForUs   int
+	CacheForUs int
+	Members    []string // trusted peers and those we pin or cache for
+}
+
+func (s *Swarm) Stats(network string) FederationStats {
+	s.l.Lock()
+	defer s.l.Unlock()
+	res := FederationStats{Members: []string{}}
+	fed, ok := s.feds[network]
+	if !ok {
+		return res
+	}
+	id := s.net.ID()
+	res.Known = len(fed.knownPeers)
+	res.Trusted = len(fed.trustedPeers)
+	res.PinFor = len(fed.pinFor)
+	res.CacheFor = len(fed.cacheFor)
+	for _, a := range fed.knownPeers {
+		if contains(a.PinFor, id) {
+			res.PinForUs++
+		}
+		if contains(a.CacheFor, id) {
+			res.CacheForUs++
+		}
+	}
+	res.Members = unique(append(append(append([]string{}, fed.trustedPeers...), fed.pinFor...), fed.cacheFor...))
+	return res
+}
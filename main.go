@@ -34,7 +34,11 @@ func main() {
 	c.Provide(swarm.NewSwarm)
 	c.Provide(GetLog)
 	c.Provide(app.NewPinManager)
+	c.Provide(app.NewPinReconciler)
+	c.Provide(app.NewReplicator)
 	c.Provide(app.NewAdminAPI)
+	c.Provide(app.NewCacheManager)
+	c.Provide(app.NewPinningService)
 
 	rootCmd := cmd.GetRootCommand(c)
 	if err := rootCmd.Execute(); err != nil {